@@ -10,9 +10,6 @@ version: 1
 runtime: go
 api_version: {{.APIVersion}}
 
-handlers:
-- url: /.*
-  script: _go_app
-`
+{{printf "%s" .Config}}`
 
 var appYAMLTempl = template.Must(template.New("app.yaml").Parse(appYAMLTemplString))
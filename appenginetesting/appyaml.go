@@ -0,0 +1,264 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+// AppYAML holds app.yaml settings merged into the app.yaml generated for
+// the child dev_appserver.py, so that tests run against the routing
+// configuration used in production.
+type AppYAML struct {
+	// File is the path of an existing app.yaml. Its inbound_services
+	// and env_variables are merged in before the fields below, and its
+	// handlers after them. The files served by its static_dir and
+	// static_files handlers are copied from its directory.
+	File string `yaml:"-"`
+
+	// Ignored lists the top-level keys of File that are left out of the
+	// generated app.yaml, besides those it sets itself. It is set by
+	// ReadAppYAML.
+	Ignored []string `yaml:"-"`
+
+	Handlers        []*Handler        `yaml:"handlers,omitempty"`
+	InboundServices []string          `yaml:"inbound_services,omitempty"`
+	EnvVariables    map[string]string `yaml:"env_variables,omitempty"`
+}
+
+// Handler is an entry of the handlers section of app.yaml.
+type Handler struct {
+	URL            string `yaml:"url"`
+	Script         string `yaml:"script,omitempty"`
+	StaticDir      string `yaml:"static_dir,omitempty"`
+	StaticFiles    string `yaml:"static_files,omitempty"`
+	Upload         string `yaml:"upload,omitempty"`
+	MimeType       string `yaml:"mime_type,omitempty"`
+	Expiration     string `yaml:"expiration,omitempty"`
+	Login          string `yaml:"login,omitempty"`  // "optional", "required" or "admin"
+	Secure         string `yaml:"secure,omitempty"` // "optional", "never" or "always"
+	AuthFailAction string `yaml:"auth_fail_action,omitempty"`
+}
+
+// helperHandlers route the requests made by Context.Call to the helper
+// application. They come first so that the handlers of the application
+// never shadow them.
+var helperHandlers = []*Handler{
+	{URL: "/(call|info)", Script: "_go_app"},
+}
+
+// catchAllHandler serves every URL not matched by another handler.
+var catchAllHandler = &Handler{URL: "/.*", Script: "_go_app"}
+
+// generatedKeys are the top-level keys set by the generated app.yaml.
+var generatedKeys = map[string]bool{
+	"application": true,
+	"version":     true,
+	"runtime":     true,
+	"api_version": true,
+}
+
+// ReadAppYAML parses the app.yaml file at path.
+func ReadAppYAML(path string) (*AppYAML, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := new(AppYAML)
+	if err := yaml.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for k := range keys {
+		switch k {
+		case "handlers", "inbound_services", "env_variables":
+		default:
+			if !generatedKeys[k] {
+				a.Ignored = append(a.Ignored, k)
+			}
+		}
+	}
+	sort.Strings(a.Ignored)
+	return a, nil
+}
+
+// merged returns the settings of a, including those of a.File, with env
+// added to the environment variables. A nil a is valid.
+func (a *AppYAML) merged(env map[string]string) (*AppYAML, error) {
+	m := new(AppYAML)
+	if a != nil && a.File != "" {
+		f, err := ReadAppYAML(a.File)
+		if err != nil {
+			return nil, err
+		}
+		m.add(f)
+	}
+	if a != nil {
+		// The handlers of a come first, so that the catch-all handlers
+		// of a.File do not shadow them.
+		o := *a
+		o.Handlers, m.Handlers = append(append([]*Handler(nil), a.Handlers...), m.Handlers...), nil
+		m.add(&o)
+	}
+	m.add(&AppYAML{EnvVariables: env})
+	return m, nil
+}
+
+func (a *AppYAML) add(o *AppYAML) {
+	a.Handlers = append(a.Handlers, o.Handlers...)
+	a.Ignored = append(a.Ignored, o.Ignored...)
+	for _, s := range o.InboundServices {
+		if !hasString(a.InboundServices, s) {
+			a.InboundServices = append(a.InboundServices, s)
+		}
+	}
+	for k, v := range o.EnvVariables {
+		if a.EnvVariables == nil {
+			a.EnvVariables = make(map[string]string)
+		}
+		a.EnvVariables[k] = v
+	}
+}
+
+// config returns the YAML of the generated app.yaml below its header.
+func (a *AppYAML) config() ([]byte, error) {
+	c := *a
+	c.Handlers = append(append(append([]*Handler(nil), helperHandlers...), a.Handlers...), catchAllHandler)
+	return yaml.Marshal(&c)
+}
+
+func hasString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the handler serving path, or nil if there is none.
+func (a *AppYAML) handler(path string) (*Handler, error) {
+	if a == nil {
+		return nil, nil
+	}
+	for _, h := range a.Handlers {
+		re, err := regexp.Compile("^(" + h.URL + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("handler url %q: %v", h.URL, err)
+		}
+		if re.MatchString(path) {
+			return h, nil
+		}
+	}
+	return nil, nil
+}
+
+// appConfigFiles are the configuration files, besides app.yaml, copied
+// from the application root into the directory of the child.
+var appConfigFiles = []string{"queue.yaml", "cron.yaml", "index.yaml", "dispatch.yaml"}
+
+// copyAppConfig copies the configuration files of the application root,
+// if any, next to the generated helper.
+func (c *Context) copyAppConfig() error {
+	if c.appRoot == "" {
+		return nil
+	}
+	for _, name := range appConfigFiles {
+		src := filepath.Join(c.appRoot, name)
+		if !fileExists(src) {
+			continue
+		}
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(c.appDir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStaticFiles copies the files served by the static_dir and
+// static_files handlers of the generated app.yaml from the directory of
+// the app.yaml they come from, or else the application root.
+func (c *Context) copyStaticFiles() error {
+	root := c.appRoot
+	if a := c.appYAMLSettings(); a != nil && a.File != "" {
+		root = filepath.Dir(a.File)
+	}
+	for _, h := range c.config.Handlers {
+		switch {
+		case h.StaticDir != "":
+			if err := copyStatic(root, c.appDir, h.StaticDir, nil); err != nil {
+				return fmt.Errorf("handler %s: %v", h.URL, err)
+			}
+		case h.StaticFiles != "":
+			re, err := regexp.Compile("^(" + h.Upload + ")$")
+			if err != nil {
+				return fmt.Errorf("handler %s: upload %q: %v", h.URL, h.Upload, err)
+			}
+			if err := copyStatic(root, c.appDir, ".", re); err != nil {
+				return fmt.Errorf("handler %s: %v", h.URL, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyStatic copies the files below dir of src to dst, keeping their
+// path relative to src. If upload is not nil, only the files whose
+// slash-separated relative path it matches are copied.
+func copyStatic(src, dst, dir string, upload *regexp.Regexp) error {
+	if filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+		return fmt.Errorf("static path %q is outside the application", dir)
+	}
+	return filepath.Walk(filepath.Join(src, dir), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if upload != nil && !upload.MatchString(filepath.ToSlash(rel)) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+}
+
+// appYAMLSettings returns the app.yaml settings of the Context, reading
+// the app.yaml of the application root unless another file is given.
+func (c *Context) appYAMLSettings() *AppYAML {
+	if c.appRoot == "" || (c.appYAML != nil && c.appYAML.File != "") {
+		return c.appYAML
+	}
+	path := filepath.Join(c.appRoot, "app.yaml")
+	if !fileExists(path) {
+		return c.appYAML
+	}
+	a := new(AppYAML)
+	if c.appYAML != nil {
+		*a = *c.appYAML
+	}
+	a.File = path
+	return a
+}
@@ -0,0 +1,110 @@
+package appenginetesting
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"appengine/taskqueue"
+)
+
+func TestAppYAMLMerge(t *testing.T) {
+	a := &AppYAML{
+		File:            "testdata/app.yaml",
+		Handlers:        []*Handler{{URL: "/cron/.*", Script: "_go_app", Login: "admin"}},
+		InboundServices: []string{"xmpp_message", "mail"},
+		EnvVariables:    map[string]string{"STAGE": "test", "DEBUG": "1"},
+	}
+	m, err := a.merged(map[string]string{"DEBUG": "0"})
+	if err != nil {
+		t.Fatalf("merged: %v", err)
+	}
+
+	if len(m.Handlers) != 5 || m.Handlers[0].URL != "/cron/.*" {
+		t.Errorf("got handlers %v; want /cron/.* followed by those of app.yaml", m.Handlers)
+	}
+	if len(m.InboundServices) != 3 {
+		t.Errorf("got inbound services %v; want mail, warmup and xmpp_message", m.InboundServices)
+	}
+	if len(m.Ignored) != 1 || m.Ignored[0] != "default_expiration" {
+		t.Errorf("got ignored settings %v; want default_expiration", m.Ignored)
+	}
+	if m.EnvVariables["STAGE"] != "test" || m.EnvVariables["DEBUG"] != "0" {
+		t.Errorf("got env_variables %v; want STAGE=test and DEBUG=0", m.EnvVariables)
+	}
+
+	h, err := m.handler("/admin/users")
+	if err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	if h == nil || h.Login != "admin" {
+		t.Errorf("got handler %+v for /admin/users; want the login: admin one", h)
+	}
+	if h, _ = m.handler("/cron/nightly"); h == nil || h.URL != "/cron/.*" {
+		t.Errorf("got handler %+v for /cron/nightly; want the /cron/.* one of the options", h)
+	}
+	if h, _ = m.handler("/home"); h == nil || h.Secure != "always" {
+		t.Errorf("got handler %+v for /home; want the catch-all of app.yaml", h)
+	}
+}
+
+func TestCopyStatic(t *testing.T) {
+	dst, err := ioutil.TempDir("", "appenginetesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := copyStatic("testdata", dst, "static", nil); err != nil {
+		t.Fatalf("copyStatic static_dir: %v", err)
+	}
+	if err := copyStatic("testdata", dst, ".", regexp.MustCompile(`^(robots\.txt)$`)); err != nil {
+		t.Fatalf("copyStatic static_files: %v", err)
+	}
+	for _, name := range []string{"static/hello.txt", "robots.txt"} {
+		if !fileExists(filepath.Join(dst, name)) {
+			t.Errorf("%s was not copied", name)
+		}
+	}
+	if fileExists(filepath.Join(dst, "app.yaml")) {
+		t.Errorf("app.yaml was copied; want only the files matching upload")
+	}
+	if err := copyStatic("testdata", dst, "../static", nil); err == nil {
+		t.Errorf("copying a static_dir outside the application succeeded")
+	}
+	if err := copyStatic("testdata", dst, "missing", nil); err == nil {
+		t.Errorf("copying a missing static_dir succeeded")
+	}
+}
+
+func TestAppDir(t *testing.T) {
+	c, err := NewContext(&Options{AppDir: "testdata"})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if !fileExists(filepath.Join(c.appDir, "queue.yaml")) {
+		t.Errorf("queue.yaml was not copied from the application root")
+	}
+	for _, name := range []string{"static/hello.txt", "robots.txt"} {
+		if !fileExists(filepath.Join(c.appDir, name)) {
+			t.Errorf("%s served by a static handler was not copied from the application root", name)
+		}
+	}
+	if fileExists(filepath.Join(c.appDir, "fixtures.json")) {
+		t.Errorf("fixtures.json was copied, but no static handler serves it")
+	}
+	h, err := c.config.handler("/admin/users")
+	if err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	if h == nil || h.Login != "admin" {
+		t.Errorf("got handler %+v for /admin/users; want the one of testdata/app.yaml", h)
+	}
+	if _, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/send", nil), "mail"); err != nil {
+		t.Errorf("adding a task to the queue of queue.yaml: %v", err)
+	}
+}
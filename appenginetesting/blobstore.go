@@ -0,0 +1,174 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+)
+
+// CreateBlob stores data in the blobstore and returns its key.
+func (c *Context) CreateBlob(contentType string, data []byte) (appengine.BlobKey, error) {
+	w, err := blobstore.Create(c, contentType)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return w.Key()
+}
+
+// UploadFile is a file of an upload form.
+type UploadFile struct {
+	Field       string // name of the form field
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// UploadRequest stores files in the blobstore and returns the request
+// the blobstore sends to path once they are uploaded through a URL of
+// blobstore.UploadURL, which blobstore.ParseUpload parses. The other
+// form fields are given by values.
+func (c *Context) UploadRequest(path string, files []UploadFile, values url.Values) (*http.Request, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, vs := range values {
+		for _, v := range vs {
+			if err := w.WriteField(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, f := range files {
+		key, err := c.CreateBlob(f.ContentType, f.Data)
+		if err != nil {
+			return nil, err
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf("form-data; name=%q; filename=%q", f.Field, f.Filename))
+		h.Set("Content-Type", fmt.Sprintf("message/external-body; blob-key=%q; access-type=X-AppEngine-BlobKey", key))
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		// The body of the part is the MIME header of the uploaded file.
+		sum := md5.Sum(f.Data)
+		fmt.Fprintf(pw, "Content-Type: %s\r\n", f.ContentType)
+		fmt.Fprintf(pw, "Content-Length: %d\r\n", len(f.Data))
+		fmt.Fprintf(pw, "Content-MD5: %s\r\n", base64.URLEncoding.EncodeToString(sum[:]))
+		fmt.Fprintf(pw, "Content-Disposition: form-data; name=%q; filename=%q\r\n", f.Field, f.Filename)
+		fmt.Fprintf(pw, "X-AppEngine-Upload-Creation: %s\r\n\r\n", time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", path, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
+
+// autoContentType is the Content-Type set by blobstore.Send when the
+// handler did not set one, to be replaced by that of the blob.
+const autoContentType = "application/vnd.google.appengine.auto"
+
+// ServeBlob replaces the response of a handler that called blobstore.Send
+// with the contents of the blob, as the App Engine front end does. Other
+// responses are left alone. A range set by the handler in the
+// X-AppEngine-BlobRange header, such as "bytes=0-99", is answered with
+// that part of the blob and status 206.
+func (c *Context) ServeBlob(w *httptest.ResponseRecorder) error {
+	key := appengine.BlobKey(w.Header().Get("X-AppEngine-BlobKey"))
+	if key == "" {
+		return nil
+	}
+	info, err := blobstore.Stat(c, key)
+	if err != nil {
+		return err
+	}
+	w.Body.Reset()
+	w.Header().Del("X-AppEngine-BlobKey")
+	if ct := w.Header().Get("Content-Type"); ct == "" || ct == autoContentType {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+
+	start, n := int64(0), info.Size
+	if rng := w.Header().Get("X-AppEngine-BlobRange"); rng != "" {
+		w.Header().Del("X-AppEngine-BlobRange")
+		var ok bool
+		if start, n, ok = blobRange(rng, info.Size); !ok {
+			w.Code = http.StatusRequestedRangeNotSatisfiable
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			w.Header().Set("Content-Length", "0")
+			return nil
+		}
+		w.Code = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, info.Size))
+	}
+	if _, err := io.Copy(w.Body, io.NewSectionReader(blobstore.NewReader(c, key), start, n)); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(n))
+	return nil
+}
+
+// blobRange returns the offset and length of the part of a blob of the
+// given size selected by rng, a single byte range such as "bytes=0-99",
+// "bytes=100-" or "bytes=-100". It reports false if rng is invalid or
+// selects no byte.
+func blobRange(rng string, size int64) (start, n int64, ok bool) {
+	if !strings.HasPrefix(rng, "bytes=") {
+		return 0, 0, false
+	}
+	i := strings.Index(rng, "-")
+	if i < 0 {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(rng[len("bytes="):i]), strings.TrimSpace(rng[i+1:])
+	if first == "" {
+		// The last bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, n > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
@@ -0,0 +1,94 @@
+package appenginetesting
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"appengine"
+	"appengine/blobstore"
+)
+
+func TestUploadRequest(t *testing.T) {
+	var uploaded appengine.BlobKey
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		blobs, other, err := blobstore.ParseUpload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(blobs["photo"]) != 1 || other.Get("title") != "Cat" {
+			http.Error(w, "unexpected upload", http.StatusBadRequest)
+			return
+		}
+		uploaded = blobs["photo"][0].BlobKey
+		http.Redirect(w, r, "/serve", http.StatusFound)
+	})
+	mux.HandleFunc("/serve", func(w http.ResponseWriter, r *http.Request) {
+		blobstore.Send(w, uploaded)
+	})
+	mux.HandleFunc("/serve-range", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-AppEngine-BlobRange", "bytes=1-2")
+		blobstore.Send(w, uploaded)
+	})
+
+	h, err := NewHarness(mux, nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+	defer h.Close()
+
+	req, err := h.Context().UploadRequest("/upload", []UploadFile{
+		{Field: "photo", Filename: "cat.png", ContentType: "image/png", Data: []byte("\x89PNG")},
+	}, url.Values{"title": {"Cat"}})
+	if err != nil {
+		t.Fatalf("UploadRequest: %v", err)
+	}
+	if w := h.Do(req); w.Code != http.StatusFound {
+		t.Fatalf("upload: got status %d; body: %q", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/serve", nil)
+	w := h.Do(req)
+	if got := w.Body.String(); got != "\x89PNG" {
+		t.Errorf("got blob %q; want %q", got, "\x89PNG")
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("got Content-Type %q; want image/png", got)
+	}
+
+	req, _ = http.NewRequest("GET", "/serve-range", nil)
+	w = h.Do(req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "PN" {
+		t.Errorf("got range response %d %q; want 206 %q", w.Code, w.Body.String(), "PN")
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 1-2/4" {
+		t.Errorf("got Content-Range %q; want bytes 1-2/4", got)
+	}
+}
+
+func TestBlobRange(t *testing.T) {
+	tests := []struct {
+		rng      string
+		start, n int64
+		ok       bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-", 100, 900, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=900-2000", 900, 100, true},
+		{"bytes=-2000", 0, 1000, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=a-b", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, n, ok := blobRange(tt.rng, 1000)
+		if ok != tt.ok || (ok && (start != tt.start || n != tt.n)) {
+			t.Errorf("blobRange(%q, 1000) = %d, %d, %v; want %d, %d, %v", tt.rng, start, n, ok, tt.start, tt.n, tt.ok)
+		}
+	}
+}
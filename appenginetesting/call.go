@@ -0,0 +1,35 @@
+package appenginetesting
+
+import (
+	"appengine_internal"
+)
+
+// A callHook sees the API calls made through a Context. It may answer a
+// call itself, fail it, or pass it on by calling next, which runs the
+// following hooks and then forwards the call to the child
+// dev_appserver.py.
+type callHook func(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error
+
+// callHooks see, in order, every API call made through a Context.
+var callHooks = []callHook{
+	checkCapabilities,
+	trackCall,
+	captureMail,
+	stubURLFetch,
+	fakeImages,
+	fakeChannel,
+	fakeXMPP,
+	fakeIdentity,
+	trackTransactions,
+	simulateConsistency,
+}
+
+// call runs the API call through callHooks, starting at the i-th one.
+func (c *Context) call(i int, service, method string, in, out appengine_internal.ProtoMessage) error {
+	if i == len(callHooks) {
+		return c.forward(service, method, in, out)
+	}
+	return callHooks[i](c, service, method, in, out, func() error {
+		return c.call(i+1, service, method, in, out)
+	})
+}
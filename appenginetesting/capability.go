@@ -0,0 +1,141 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"sync"
+
+	"appengine_internal"
+	capabilitypb "appengine_internal/capability"
+	pb "appengine_internal/datastore"
+)
+
+// capabilityDisabledCode is the code of the call errors of the API
+// calls made to a disabled capability, other than datastore ones: that
+// of RpcError.CAPABILITY_DISABLED in the remote_api protocol buffers.
+const capabilityDisabledCode = 6
+
+// capabilityMethods are the methods of the capabilities that can be
+// disabled, by package, other than "*" for a whole package.
+var capabilityMethods = map[string]map[string][]string{
+	"datastore_v3": {
+		"read":  {"Get", "RunQuery", "Next"},
+		"write": {"Put", "Delete", "Commit"},
+	},
+	"mail": {
+		"send": {"Send", "SendToAdmins"},
+	},
+}
+
+// capabilities holds the disabled capabilities, by package.
+type capabilities struct {
+	mu       sync.Mutex
+	disabled map[string]map[string]bool
+}
+
+func newCapabilities() *capabilities {
+	return &capabilities{disabled: make(map[string]map[string]bool)}
+}
+
+// DisableCapability makes capability.Enabled report the capability of the
+// API package as disabled, as it is during a maintenance period, and the
+// matching calls fail with a CAPABILITY_DISABLED error. The capability
+// "*" stands for the whole package; the others are "read" and "write" of
+// datastore_v3 and "send" of mail.
+func (c *Context) DisableCapability(api, capability string) error {
+	if capability != "*" && capabilityMethods[api][capability] == nil {
+		return fmt.Errorf("appenginetesting: cannot disable capability %q of %s", capability, api)
+	}
+	cs := c.caps
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.disabled[api] == nil {
+		cs.disabled[api] = make(map[string]bool)
+	}
+	cs.disabled[api][capability] = true
+	return nil
+}
+
+// EnableCapability undoes DisableCapability. The capability "*" enables
+// the whole package again, including the capabilities disabled one by
+// one.
+func (c *Context) EnableCapability(api, capability string) {
+	cs := c.caps
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if capability == "*" {
+		delete(cs.disabled, api)
+		return
+	}
+	delete(cs.disabled[api], capability)
+}
+
+// enabled reports whether the capabilities of the API package are
+// enabled.
+func (cs *capabilities) enabled(api string, capabilities ...string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.disabled[api]["*"] {
+		return false
+	}
+	for _, capability := range capabilities {
+		if cs.disabled[api][capability] {
+			return false
+		}
+	}
+	return true
+}
+
+// callEnabled reports whether the capabilities of the method of the API
+// package are enabled.
+func (cs *capabilities) callEnabled(api, method string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.disabled[api]["*"] {
+		return false
+	}
+	for capability := range cs.disabled[api] {
+		for _, m := range capabilityMethods[api][capability] {
+			if m == method {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkCapabilities is the callHook answering capability_service calls
+// and failing the calls to disabled capabilities. The channel calls, which
+// the Go runtime makes to the xmpp service, belong to the channel
+// package.
+func checkCapabilities(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	cs := c.caps
+	if service == "capability_service" && method == "IsEnabled" {
+		req := in.(*capabilitypb.IsEnabledRequest)
+		status := capabilitypb.IsEnabledResponse_ENABLED
+		if !cs.enabled(req.GetPackage(), req.Capability...) {
+			status = capabilitypb.IsEnabledResponse_DISABLED
+		}
+		out.(*capabilitypb.IsEnabledResponse).SummaryStatus = status.Enum()
+		return nil
+	}
+	api := service
+	if service == "xmpp" && (method == "CreateChannel" || method == "SendChannelMessage") {
+		api = "channel"
+	}
+	if !cs.callEnabled(api, method) {
+		return capabilityDisabled(service, method)
+	}
+	return next()
+}
+
+func capabilityDisabled(service, method string) error {
+	detail := fmt.Sprintf("%s.%s is disabled", service, method)
+	if service == "datastore_v3" {
+		return &appengine_internal.APIError{
+			Service: service,
+			Detail:  detail,
+			Code:    int32(pb.Error_CAPABILITY_DISABLED),
+		}
+	}
+	return &appengine_internal.CallError{Detail: detail, Code: capabilityDisabledCode}
+}
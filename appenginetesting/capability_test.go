@@ -0,0 +1,132 @@
+package appenginetesting
+
+import (
+	"testing"
+
+	"appengine/capability"
+	"appengine/channel"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/memcache"
+	"appengine/xmpp"
+)
+
+func TestDisableCapability(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	key := datastore.NewKey(c, "Entity", "a", 0, nil)
+	if _, err := datastore.Put(c, key, &Entity{Foo: "1"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := c.DisableCapability("datastore_v3", "write"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	if capability.Enabled(c, "datastore_v3", "write") {
+		t.Errorf("datastore_v3 write is enabled; want disabled")
+	}
+	if !capability.Enabled(c, "datastore_v3", "read") {
+		t.Errorf("datastore_v3 read is disabled; want enabled")
+	}
+	if _, err := datastore.Put(c, key, &Entity{Foo: "2"}); err == nil {
+		t.Errorf("Put succeeded with writes disabled")
+	}
+	var e Entity
+	if err := datastore.Get(c, key, &e); err != nil || e.Foo != "1" {
+		t.Errorf("Get = %+v, %v; want Foo 1", e, err)
+	}
+
+	if err := c.DisableCapability("memcache", "*"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	if capability.Enabled(c, "memcache", "set") {
+		t.Errorf("memcache set is enabled; want disabled")
+	}
+	if err := memcache.Set(c, &memcache.Item{Key: "k", Value: []byte("v")}); err == nil {
+		t.Errorf("memcache.Set succeeded with memcache disabled")
+	}
+
+	if err := c.DisableCapability("mail", "send"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	msg := &mail.Message{Sender: "app@example.com", To: []string{"alice@example.com"}, Subject: "Hi"}
+	if err := mail.Send(c, msg); err == nil {
+		t.Errorf("mail.Send succeeded with sending disabled")
+	}
+	if got := c.Mail().Messages(); len(got) != 0 {
+		t.Errorf("got sent mail %+v with sending disabled; want none", got)
+	}
+
+	if err := c.DisableCapability("datastore_v3", "read"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	if err := datastore.Get(c, key, &e); err == nil {
+		t.Errorf("Get succeeded with reads disabled")
+	}
+	if err := c.DisableCapability("memcache", "get"); err == nil {
+		t.Errorf("disabling a capability that cannot be simulated succeeded")
+	}
+
+	c.EnableCapability("datastore_v3", "*")
+	c.EnableCapability("memcache", "*")
+	if _, err := datastore.Put(c, key, &Entity{Foo: "2"}); err != nil {
+		t.Errorf("Put after EnableCapability: %v", err)
+	}
+	if err := memcache.Set(c, &memcache.Item{Key: "k", Value: []byte("v")}); err != nil {
+		t.Errorf("memcache.Set after EnableCapability: %v", err)
+	}
+	if err := datastore.Get(c, key, &e); err != nil {
+		t.Errorf("Get after EnableCapability of the whole package: %v", err)
+	}
+
+	// The channel calls go to the xmpp service, but belong to the
+	// channel package.
+	if err := c.DisableCapability("xmpp", "*"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	if err := (&xmpp.Message{Sender: "bot@testapp.appspotchat.com", To: []string{"alice@example.com"}, Body: "hi"}).Send(c); err == nil {
+		t.Errorf("xmpp Send succeeded with xmpp disabled")
+	}
+	if _, err := channel.Create(c, "alice"); err != nil {
+		t.Errorf("channel.Create with xmpp disabled: %v", err)
+	}
+	if err := c.DisableCapability("channel", "*"); err != nil {
+		t.Fatalf("DisableCapability: %v", err)
+	}
+	if _, err := channel.Create(c, "bob"); err == nil {
+		t.Errorf("channel.Create succeeded with channel disabled")
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	c := newContext(nil, nil)
+	next := func() error { return nil }
+	check := func(service, method string) error {
+		return checkCapabilities(c, service, method, nil, nil, next)
+	}
+
+	c.DisableCapability("xmpp", "*")
+	if err := check("xmpp", "SendMessage"); err == nil {
+		t.Errorf("xmpp SendMessage succeeded with xmpp disabled")
+	}
+	if err := check("xmpp", "CreateChannel"); err != nil {
+		t.Errorf("CreateChannel with xmpp disabled: %v", err)
+	}
+	c.DisableCapability("channel", "*")
+	if err := check("xmpp", "SendChannelMessage"); err == nil {
+		t.Errorf("SendChannelMessage succeeded with channel disabled")
+	}
+
+	c.DisableCapability("datastore_v3", "read")
+	c.DisableCapability("datastore_v3", "write")
+	c.EnableCapability("datastore_v3", "*")
+	for _, method := range []string{"Get", "Put"} {
+		if err := check("datastore_v3", method); err != nil {
+			t.Errorf("datastore_v3 %s after enabling the whole package: %v", method, err)
+		}
+	}
+}
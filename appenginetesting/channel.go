@@ -0,0 +1,106 @@
+package appenginetesting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine_internal"
+	channelpb "appengine_internal/channel"
+)
+
+// Channels holds the channels created and the messages sent with
+// appengine/channel through the Contexts sharing a child. The calls are
+// answered in process.
+type Channels struct {
+	mu       sync.Mutex
+	tokens   map[string]string   // by client ID
+	messages map[string][]string // by client ID
+}
+
+func newChannels() *Channels {
+	return &Channels{
+		tokens:   make(map[string]string),
+		messages: make(map[string][]string),
+	}
+}
+
+// Channels returns the channels of c.
+func (c *Context) Channels() *Channels {
+	return c.channels
+}
+
+// Token returns the token returned by channel.Create for the client ID,
+// or "" if no channel was created for it.
+func (ch *Channels) Token(clientID string) string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.tokens[clientID]
+}
+
+// Messages returns the messages sent to the client ID with channel.Send
+// or channel.SendJSON, in order.
+func (ch *Channels) Messages(clientID string) []string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return append([]string(nil), ch.messages[clientID]...)
+}
+
+// Clear forgets the channels and messages.
+func (ch *Channels) Clear() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.tokens = make(map[string]string)
+	ch.messages = make(map[string][]string)
+}
+
+// ConnectChannel POSTs to h the presence notification App Engine sends to
+// /_ah/channel/connected/ when the client ID connects to its channel.
+func (c *Context) ConnectChannel(h http.Handler, clientID string) *httptest.ResponseRecorder {
+	return postChannelPresence(h, "connected", clientID)
+}
+
+// DisconnectChannel POSTs to h the presence notification App Engine sends
+// to /_ah/channel/disconnected/ when the client ID leaves its channel.
+func (c *Context) DisconnectChannel(h http.Handler, clientID string) *httptest.ResponseRecorder {
+	return postChannelPresence(h, "disconnected", clientID)
+}
+
+func postChannelPresence(h http.Handler, presence, clientID string) *httptest.ResponseRecorder {
+	form := url.Values{"from": {clientID}}
+	req, _ := http.NewRequest("POST", "/_ah/channel/"+presence+"/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// fakeChannel is the callHook answering the channel calls, which the Go
+// runtime makes to the xmpp service.
+func fakeChannel(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "xmpp" && service != "channel" {
+		return next()
+	}
+	ch := c.channels
+	switch method {
+	case "CreateChannel":
+		clientID := in.(*channelpb.CreateChannelRequest).GetApplicationKey()
+		token := "channel-" + clientID
+		ch.mu.Lock()
+		ch.tokens[clientID] = token
+		ch.mu.Unlock()
+		out.(*channelpb.CreateChannelResponse).Token = proto.String(token)
+		return nil
+	case "SendChannelMessage":
+		req := in.(*channelpb.SendMessageRequest)
+		ch.mu.Lock()
+		ch.messages[req.GetApplicationKey()] = append(ch.messages[req.GetApplicationKey()], req.GetMessage())
+		ch.mu.Unlock()
+		return nil
+	}
+	return next()
+}
@@ -0,0 +1,51 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"appengine/channel"
+)
+
+func TestChannels(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	token, err := channel.Create(c, "alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if token == "" || c.Channels().Token("alice") != token {
+		t.Errorf("got token %q; Token returns %q", token, c.Channels().Token("alice"))
+	}
+	if err := channel.Send(c, "alice", "hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := channel.SendJSON(c, "alice", map[string]int{"unread": 2}); err != nil {
+		t.Fatalf("SendJSON: %v", err)
+	}
+	want := []string{"hello", `{"unread":2}`}
+	if got := c.Channels().Messages("alice"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %q; want %q", got, want)
+	}
+	if got := c.Channels().Messages("bob"); len(got) != 0 {
+		t.Errorf("got messages %q for bob; want none", got)
+	}
+
+	var presence []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ah/channel/", func(w http.ResponseWriter, r *http.Request) {
+		presence = append(presence, fmt.Sprintf("%s %s", r.URL.Path, r.FormValue("from")))
+	})
+	c.ConnectChannel(mux, "alice")
+	c.DisconnectChannel(mux, "alice")
+	want = []string{"/_ah/channel/connected/ alice", "/_ah/channel/disconnected/ alice"}
+	if !reflect.DeepEqual(presence, want) {
+		t.Errorf("got presence requests %q; want %q", presence, want)
+	}
+}
@@ -0,0 +1,231 @@
+package appenginetesting
+
+import (
+	"math/rand"
+	"sync"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+)
+
+// ConsistencyMode chooses when a datastore write made outside of a
+// transaction becomes visible to queries that are not ancestor queries.
+type ConsistencyMode int
+
+const (
+	// Consistent makes every write visible at once, to every query.
+	Consistent ConsistencyMode = iota
+
+	// RandomConsistency applies each pending write with a given
+	// probability whenever a global query runs.
+	RandomConsistency
+
+	// ApplyOnRead applies a pending write only when its entity group is
+	// read by a Get, an ancestor query or a transaction.
+	ApplyOnRead
+)
+
+// Consistency simulates the eventual consistency of the High Replication
+// Datastore. In production, a query that is not an ancestor query may not
+// see the writes made just before it; a Get, an ancestor query or a
+// transaction always sees the latest writes of its entity groups.
+type Consistency struct {
+	Mode ConsistencyMode
+
+	// Probability is the probability with which RandomConsistency
+	// applies a pending write, from 0 (never) to 1 (always).
+	Probability float64
+
+	// Seed seeds the random choices of RandomConsistency, so that a
+	// failing test can be run again with the same writes hidden.
+	Seed int64
+}
+
+// consistency holds the writes of a Context not yet visible to global
+// queries. They are sent to the child dev_appserver.py, itself strongly
+// consistent, only once applied.
+type consistency struct {
+	Consistency
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	pending []*pendingWrite // in write order
+}
+
+// pendingWrite is a Put or Delete of entities of one entity group.
+type pendingWrite struct {
+	group  string
+	put    *pb.PutRequest
+	delete *pb.DeleteRequest
+}
+
+func newConsistency(opts *Consistency) *consistency {
+	if opts == nil || opts.Mode == Consistent {
+		return nil
+	}
+	return &consistency{
+		Consistency: *opts,
+		rand:        rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// simulateConsistency is the callHook delaying the datastore writes made
+// outside of transactions according to Options.Consistency.
+func simulateConsistency(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	s := c.consistency
+	if s == nil || service != "datastore_v3" {
+		return next()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch method {
+	case "Put":
+		req := in.(*pb.PutRequest)
+		if req.Transaction != nil {
+			if err := s.applyEntities(c, req.Entity); err != nil {
+				return err
+			}
+			return next()
+		}
+		return s.delayPut(c, req, out.(*pb.PutResponse))
+	case "Delete":
+		req := in.(*pb.DeleteRequest)
+		if req.Transaction != nil {
+			if err := s.applyKeys(c, req.Key); err != nil {
+				return err
+			}
+			return next()
+		}
+		s.delayDelete(req)
+		return nil
+	case "Get":
+		if err := s.applyKeys(c, in.(*pb.GetRequest).Key); err != nil {
+			return err
+		}
+	case "RunQuery":
+		q := in.(*pb.Query)
+		var err error
+		switch {
+		case q.Ancestor != nil:
+			err = s.applyKeys(c, []*pb.Reference{q.Ancestor})
+		case s.Mode == RandomConsistency:
+			err = s.applyRandomly(c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return next()
+}
+
+// delayPut records the entities of req as pending writes and answers it
+// with their keys, allocating IDs for the incomplete ones. The entities
+// are not checked by the child until the writes are applied.
+func (s *consistency) delayPut(c *Context, req *pb.PutRequest, res *pb.PutResponse) error {
+	res.Key = nil
+	for _, e := range req.Entity {
+		if err := completeKey(c, e.Key); err != nil {
+			return err
+		}
+		s.pending = append(s.pending, &pendingWrite{
+			group: entityGroup(e.Key),
+			put:   &pb.PutRequest{Entity: []*pb.EntityProto{e}},
+		})
+		res.Key = append(res.Key, e.Key)
+	}
+	return nil
+}
+
+func (s *consistency) delayDelete(req *pb.DeleteRequest) {
+	for _, k := range req.Key {
+		s.pending = append(s.pending, &pendingWrite{
+			group:  entityGroup(k),
+			delete: &pb.DeleteRequest{Key: []*pb.Reference{k}},
+		})
+	}
+}
+
+// completeKey sets an allocated ID in the last element of k if it has
+// neither an ID nor a name.
+func completeKey(c *Context, k *pb.Reference) error {
+	elems := k.GetPath().GetElement()
+	last := elems[len(elems)-1]
+	if last.GetId() != 0 || last.GetName() != "" {
+		return nil
+	}
+	req := &pb.AllocateIdsRequest{ModelKey: k, Size: proto.Int64(1)}
+	res := &pb.AllocateIdsResponse{}
+	if err := c.forward("datastore_v3", "AllocateIds", req, res); err != nil {
+		return err
+	}
+	last.Id = proto.Int64(res.GetStart())
+	return nil
+}
+
+func (s *consistency) applyEntities(c *Context, entities []*pb.EntityProto) error {
+	keys := make([]*pb.Reference, len(entities))
+	for i, e := range entities {
+		keys[i] = e.Key
+	}
+	return s.applyKeys(c, keys)
+}
+
+// applyKeys applies the pending writes of the entity groups of keys.
+func (s *consistency) applyKeys(c *Context, keys []*pb.Reference) error {
+	groups := make(map[string]bool)
+	for _, k := range keys {
+		groups[entityGroup(k)] = true
+	}
+	return s.apply(c, func(w *pendingWrite) bool { return groups[w.group] })
+}
+
+// applyRandomly applies the pending writes of each entity group with
+// probability s.Probability.
+func (s *consistency) applyRandomly(c *Context) error {
+	chosen := make(map[string]bool)
+	for _, w := range s.pending {
+		if _, ok := chosen[w.group]; !ok {
+			chosen[w.group] = s.rand.Float64() < s.Probability
+		}
+	}
+	return s.apply(c, func(w *pendingWrite) bool { return chosen[w.group] })
+}
+
+// apply sends the pending writes selected by f to the child, in order.
+func (s *consistency) apply(c *Context, f func(*pendingWrite) bool) error {
+	var kept []*pendingWrite
+	for i, w := range s.pending {
+		if !f(w) {
+			kept = append(kept, w)
+			continue
+		}
+		var err error
+		if w.put != nil {
+			err = c.forward("datastore_v3", "Put", w.put, &pb.PutResponse{})
+		} else {
+			err = c.forward("datastore_v3", "Delete", w.delete, &pb.DeleteResponse{})
+		}
+		if err != nil {
+			s.pending = append(kept, s.pending[i:]...)
+			return err
+		}
+	}
+	s.pending = kept
+	return nil
+}
+
+// ApplyWrites makes every pending datastore write visible to all queries,
+// as if the time needed for the High Replication Datastore to apply them
+// had passed. It does nothing unless Options.Consistency delays writes.
+func (c *Context) ApplyWrites() error {
+	s := c.consistency
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(c, func(*pendingWrite) bool { return true })
+}
@@ -0,0 +1,119 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"appengine/datastore"
+)
+
+func TestApplyOnRead(t *testing.T) {
+	c, err := NewContext(&Options{Consistency: &Consistency{Mode: ApplyOnRead}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", parent), &Entity{Foo: "foo"})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if key.Incomplete() {
+		t.Fatalf("Put returned incomplete key %v", key)
+	}
+
+	count := func(q *datastore.Query) int {
+		n, err := q.Count(c)
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		return n
+	}
+	if n := count(datastore.NewQuery("Entity")); n != 0 {
+		t.Errorf("global query saw %d entities before a read; want 0", n)
+	}
+	if n := count(datastore.NewQuery("Entity").Ancestor(parent)); n != 1 {
+		t.Errorf("ancestor query saw %d entities; want 1", n)
+	}
+	if n := count(datastore.NewQuery("Entity")); n != 1 {
+		t.Errorf("global query saw %d entities after an ancestor query; want 1", n)
+	}
+
+	if err := datastore.Delete(c, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if n := count(datastore.NewQuery("Entity")); n != 1 {
+		t.Errorf("global query saw %d entities before the delete was applied; want 1", n)
+	}
+	if err := c.ApplyWrites(); err != nil {
+		t.Fatalf("ApplyWrites: %v", err)
+	}
+	if n := count(datastore.NewQuery("Entity")); n != 0 {
+		t.Errorf("global query saw %d entities after ApplyWrites; want 0", n)
+	}
+}
+
+func TestRandomConsistency(t *testing.T) {
+	const seed = 42
+	c, err := NewContext(&Options{Consistency: &Consistency{Mode: RandomConsistency, Probability: 0.5, Seed: seed}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	// One entity group per entity, written in order.
+	var keys []*datastore.Key
+	var entities []Entity
+	for i := 0; i < 10; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", fmt.Sprintf("e%d", i), 0, nil))
+		entities = append(entities, Entity{Foo: "foo"})
+	}
+	if _, err := datastore.PutMulti(c, keys, entities); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+
+	// The first global query draws once per pending group, in write
+	// order; the second one draws again for the groups left.
+	r := rand.New(rand.NewSource(seed))
+	var want [2][]string
+	var left []*datastore.Key
+	for _, k := range keys {
+		if r.Float64() < 0.5 {
+			want[0] = append(want[0], k.StringID())
+		} else {
+			left = append(left, k)
+		}
+	}
+	want[1] = append(want[1], want[0]...)
+	for _, k := range left {
+		if r.Float64() < 0.5 {
+			want[1] = append(want[1], k.StringID())
+		}
+	}
+	sort.Strings(want[1])
+	if len(want[0]) == 0 || len(want[0]) == len(keys) {
+		t.Fatalf("seed %d applies %d of %d writes at once; pick a seed hiding some of them", seed, len(want[0]), len(keys))
+	}
+
+	for i := range want {
+		got, err := datastore.NewQuery("Entity").KeysOnly().GetAll(c, nil)
+		if err != nil {
+			t.Fatalf("GetAll: %v", err)
+		}
+		var ids []string
+		for _, k := range got {
+			ids = append(ids, k.StringID())
+		}
+		if !reflect.DeepEqual(ids, want[i]) {
+			t.Errorf("global query %d saw %q; want %q", i+1, ids, want[i])
+		}
+	}
+
+	if s := newConsistency(&Consistency{Mode: Consistent}); s != nil {
+		t.Errorf("Consistent mode simulates consistency")
+	}
+}
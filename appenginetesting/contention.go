@@ -0,0 +1,232 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"sync"
+
+	"appengine/datastore"
+	"appengine_internal"
+	basepb "appengine_internal/base"
+	pb "appengine_internal/datastore"
+)
+
+// transactions tracks the entity groups used by the open datastore
+// transactions of the Contexts sharing a child, to make their commits
+// fail as they would in production under contention.
+type transactions struct {
+	contention bool // fail commits when a group changed since it was read
+	enforceXG  bool // limit the groups of a transaction as in production
+
+	mu       sync.Mutex
+	open     map[uint64]*transaction // by handle
+	versions map[string]int64        // bumped by every write, by group
+	failures map[string]int          // commits left to fail, by group
+}
+
+// transaction is an open datastore transaction.
+type transaction struct {
+	xg      bool             // a cross-group transaction
+	groups  map[string]int64 // version when first used, by group
+	written map[string]bool
+}
+
+// MaxXGEntityGroups is the maximum number of entity groups a cross-group
+// transaction may use with the supported SDK, 1.8.2. Its datastore stub
+// enforces it too, so only the check of non cross-group transactions is
+// missing from dev_appserver.py.
+const MaxXGEntityGroups = 5
+
+// Errors of transactions using more entity groups than allowed, worded
+// as in production.
+var (
+	errCrossGroup = &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  "cross-group transaction need to be explicitly specified, see TransactionOptions.Builder.withXG",
+		Code:    int32(pb.Error_BAD_REQUEST),
+	}
+	errTooManyGroups = &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  "operating on too many entity groups in a single transaction.",
+		Code:    int32(pb.Error_BAD_REQUEST),
+	}
+)
+
+func newTransactions(contention, enforceXG bool) *transactions {
+	return &transactions{
+		contention: contention,
+		enforceXG:  enforceXG,
+		open:       make(map[uint64]*transaction),
+		versions:   make(map[string]int64),
+		failures:   make(map[string]int),
+	}
+}
+
+// FailCommits makes the next n commits of transactions using the entity
+// group of key fail with datastore.ErrConcurrentTransaction, so that
+// callers of datastore.RunInTransaction can be tested for retries.
+func (c *Context) FailCommits(key *datastore.Key, n int) {
+	t := c.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[keyGroup(key)] = n
+}
+
+// errConcurrentTransaction is the error of a commit failing because of
+// contention, which datastore.RunInTransaction turns into
+// datastore.ErrConcurrentTransaction.
+var errConcurrentTransaction = &appengine_internal.APIError{
+	Service: "datastore_v3",
+	Detail:  "too much contention on these datastore entities. please try again.",
+	Code:    int32(pb.Error_CONCURRENT_TRANSACTION),
+}
+
+// trackTransactions is the callHook recording the entity groups used by
+// transactions and failing their commits under contention.
+func trackTransactions(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "datastore_v3" {
+		return next()
+	}
+	t := c.txns
+
+	switch method {
+	case "BeginTransaction":
+		if err := next(); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.open[out.(*pb.Transaction).GetHandle()] = &transaction{
+			xg:      in.(*pb.BeginTransactionRequest).GetAllowMultipleEg(),
+			groups:  make(map[string]int64),
+			written: make(map[string]bool),
+		}
+		t.mu.Unlock()
+		return nil
+	case "Get":
+		req := in.(*pb.GetRequest)
+		if err := t.use(req.Transaction, req.Key, false); err != nil {
+			return err
+		}
+	case "RunQuery":
+		q := in.(*pb.Query)
+		if q.Ancestor != nil {
+			if err := t.use(q.Transaction, []*pb.Reference{q.Ancestor}, false); err != nil {
+				return err
+			}
+		}
+	case "Put":
+		req := in.(*pb.PutRequest)
+		return t.write(req.Transaction, func() []*pb.Reference { return out.(*pb.PutResponse).Key }, next)
+	case "Delete":
+		req := in.(*pb.DeleteRequest)
+		return t.write(req.Transaction, func() []*pb.Reference { return req.Key }, next)
+	case "Commit":
+		return t.commit(c, in.(*pb.Transaction), next)
+	case "Rollback":
+		t.mu.Lock()
+		delete(t.open, in.(*pb.Transaction).GetHandle())
+		t.mu.Unlock()
+	}
+	return next()
+}
+
+// use records the entity groups of keys as used by tx, if not nil. With
+// Options.EnforceXG, it fails if tx may not use that many groups.
+func (t *transactions) use(tx *pb.Transaction, keys []*pb.Reference, write bool) error {
+	if tx == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.open[tx.GetHandle()]
+	if s == nil {
+		return nil
+	}
+	for _, k := range keys {
+		g := entityGroup(k)
+		if _, ok := s.groups[g]; !ok {
+			switch {
+			case t.enforceXG && !s.xg && len(s.groups) > 0:
+				return errCrossGroup
+			case t.enforceXG && len(s.groups) >= MaxXGEntityGroups:
+				return errTooManyGroups
+			}
+			s.groups[g] = t.versions[g]
+		}
+		if write {
+			s.written[g] = true
+		}
+	}
+	return nil
+}
+
+// write records a Put or Delete of the keys returned by keys once done.
+// Outside of a transaction, it changes the version of their groups.
+func (t *transactions) write(tx *pb.Transaction, keys func() []*pb.Reference, next func() error) error {
+	if err := next(); err != nil {
+		return err
+	}
+	if tx != nil {
+		return t.use(tx, keys(), true)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys() {
+		t.versions[entityGroup(k)]++
+	}
+	return nil
+}
+
+// commit commits tx, unless FailCommits or a concurrent write to one of
+// its groups makes it fail, in which case it is rolled back instead.
+func (t *transactions) commit(c *Context, tx *pb.Transaction, next func() error) error {
+	t.mu.Lock()
+	s := t.open[tx.GetHandle()]
+	delete(t.open, tx.GetHandle())
+	fail := false
+	if s != nil {
+		for g, version := range s.groups {
+			if t.failures[g] > 0 {
+				t.failures[g]--
+				fail = true
+			}
+			if t.contention && t.versions[g] != version {
+				fail = true
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if fail {
+		if err := c.forward("datastore_v3", "Rollback", tx, &basepb.VoidProto{}); err != nil {
+			return err
+		}
+		return errConcurrentTransaction
+	}
+	if err := next(); err != nil {
+		return err
+	}
+	if s != nil {
+		t.mu.Lock()
+		for g := range s.written {
+			t.versions[g]++
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// entityGroup identifies the entity group of k.
+func entityGroup(k *pb.Reference) string {
+	root := k.GetPath().GetElement()[0]
+	return groupID(k.GetApp(), k.GetNameSpace(), root.GetType(), root.GetId(), root.GetName())
+}
+
+// keyGroup identifies the entity group of k, like entityGroup.
+func keyGroup(k *datastore.Key) string {
+	root := keyPath(k)[0]
+	return groupID(root.AppID(), root.Namespace(), root.Kind(), root.IntID(), root.StringID())
+}
+
+func groupID(app, ns, kind string, id int64, name string) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%s", app, ns, kind, id, name)
+}
@@ -0,0 +1,112 @@
+package appenginetesting
+
+import (
+	"testing"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func TestFailCommits(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	key := datastore.NewKey(c, "Entity", "e", 0, nil)
+	attempts := 0
+	put := func(tc appengine.Context) error {
+		attempts++
+		_, err := datastore.Put(tc, key, &Entity{Foo: "foo"})
+		return err
+	}
+
+	c.FailCommits(key, 2)
+	if err := datastore.RunInTransaction(c, put, &datastore.TransactionOptions{Attempts: 3}); err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts; want 3", attempts)
+	}
+
+	attempts = 0
+	c.FailCommits(key, 5)
+	err = datastore.RunInTransaction(c, put, &datastore.TransactionOptions{Attempts: 3})
+	if err != datastore.ErrConcurrentTransaction {
+		t.Errorf("got error %v; want ErrConcurrentTransaction", err)
+	}
+}
+
+func TestContention(t *testing.T) {
+	c, err := NewContext(&Options{Contention: true})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	key := datastore.NewKey(c, "Entity", "e", 0, nil)
+	if _, err := datastore.Put(c, key, &Entity{Foo: "foo"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	attempts := 0
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		attempts++
+		var e Entity
+		if err := datastore.Get(tc, key, &e); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// A concurrent write to the group read by the transaction.
+			if _, err := datastore.Put(c, key, &Entity{Foo: "other"}); err != nil {
+				return err
+			}
+		}
+		e.Bar = "bar"
+		_, err := datastore.Put(tc, key, &e)
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts; want 2", attempts)
+	}
+}
+
+func TestEnforceXG(t *testing.T) {
+	c, err := NewContext(&Options{EnforceXG: true})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	putGroups := func(n int) func(appengine.Context) error {
+		return func(tc appengine.Context) error {
+			for i := 1; i <= n; i++ {
+				if _, err := datastore.Put(tc, datastore.NewKey(tc, "Entity", "", int64(i), nil), &Entity{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	tests := []struct {
+		groups int
+		xg     bool
+		err    error
+	}{
+		{1, false, nil},
+		{2, false, errCrossGroup},
+		{MaxXGEntityGroups, true, nil},
+		{MaxXGEntityGroups + 1, true, errTooManyGroups},
+	}
+	for _, tt := range tests {
+		err := datastore.RunInTransaction(c, putGroups(tt.groups), &datastore.TransactionOptions{XG: tt.xg})
+		if err != tt.err {
+			t.Errorf("%d groups with XG %v: got error %v; want %v", tt.groups, tt.xg, err, tt.err)
+		}
+	}
+}
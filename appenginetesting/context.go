@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"net"
@@ -19,7 +20,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -65,9 +68,32 @@ type Context struct {
 	port       int      // of child dev_appserver.py http server
 	adminPort  int      // of child administration dev_appserver.py http server
 	appDir     string   // temp dir for application files
+	storageDir string   // temp dir for the datastore and blobstore of the child
 	queues     []string // list of queues to support
 	debug      string   // send the output of the application to console
 	debugChild bool     // send the output of the dev_appserver to console, for debugging appenginetesting
+	err        error    // returned by every API call if the child failed to start
+
+	env        map[string]string // application environment variables
+	restoreEnv func()            // restores the process environment changed for env
+	closeOnce  *sync.Once        // shared by the copies made by withRequest
+	appYAML    *AppYAML          // app.yaml settings from Options
+	config     *AppYAML          // settings of the generated app.yaml
+	appRoot    string            // root of the application under test
+	hostname   string            // X-AppEngine-Default-Version-Hostname of the requests
+
+	requireIndexes bool   // fail queries missing from index.yaml
+	cronYAML       string // path of cron.yaml
+
+	tracked     *tracker     // memcache keys and tasks, for Snapshot
+	consistency *consistency // nil if writes are visible at once
+	txns        *transactions
+	outbox      *Outbox
+	urlfetch    *FetchStub
+	xmpp        *XMPP
+	identity    *Identity
+	caps        *capabilities
+	channels    *Channels
 }
 
 func (c *Context) AppID() string {
@@ -100,6 +126,9 @@ func (c *Context) Criticalf(format string, args ...interface{}) { c.logf("critic
 func (c *Context) Errorf(format string, args ...interface{})    { c.logf("error", format, args...) }
 
 func (c *Context) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if c.err != nil {
+		return c.err
+	}
 	if service == "__go__" {
 		if method == "GetNamespace" {
 			out.(*basepb.StringProto).Value = proto.String(c.req.Header.Get("X-AppEngine-Current-Namespace"))
@@ -111,6 +140,11 @@ func (c *Context) Call(service, method string, in, out appengine_internal.ProtoM
 		}
 	}
 
+	return c.call(0, service, method, in, out)
+}
+
+// forward sends an API call to the child dev_appserver.py.
+func (c *Context) forward(service, method string, in, out appengine_internal.ProtoMessage) error {
 	if Verbose {
 		fmt.Println("INPUT:")
 		fmt.Println(in)
@@ -131,6 +165,9 @@ func (c *Context) Call(service, method string, in, out appengine_internal.ProtoM
 	}
 	if res.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(res.Body)
+		if err := indexError(body); err != nil {
+			return err
+		}
 		return fmt.Errorf("got status %d; body: %q", res.StatusCode, body)
 	}
 	pbytes, err := ioutil.ReadAll(res.Body)
@@ -158,21 +195,70 @@ func (c *Context) Request() interface{} {
 }
 
 // Close kills the child dev_appserver.py process, releasing its
-// resources.
+// resources. Closing any of the Contexts sharing a child closes it for
+// all of them; later calls do nothing.
 //
 // Close is not part of the appengine.Context interface.
 func (c *Context) Close() {
-	if c == nil || c.child == nil {
+	if c == nil {
 		return
 	}
-	if p := c.child.Process; p != nil {
-		p.Signal(syscall.SIGTERM)
+	c.closeOnce.Do(c.close)
+}
+
+func (c *Context) close() {
+	if c.child != nil && c.child.Process != nil {
+		c.child.Process.Signal(syscall.SIGTERM)
+	}
+	if c.appDir != "" {
+		os.RemoveAll(c.appDir)
+	}
+	if c.storageDir != "" {
+		os.RemoveAll(c.storageDir)
+	}
+	if c.restoreEnv != nil {
+		c.restoreEnv()
 	}
-	os.RemoveAll(c.appDir)
-	c.child = nil
 	currentContext = nil
 }
 
+// Login makes user.Current report the user with the given email as
+// logged in to the request of c, as an administrator if admin is set.
+// Each email gets its own user ID.
+//
+// Login is not part of the appengine.Context interface.
+func (c *Context) Login(email string, admin bool) {
+	h := fnv.New64a()
+	h.Write([]byte(email))
+	c.req.Header.Set("X-AppEngine-User-Email", email)
+	c.req.Header.Set("X-AppEngine-User-Id", strconv.FormatUint(h.Sum64(), 10))
+	c.req.Header.Set("X-AppEngine-Auth-Domain", "gmail.com")
+	if admin {
+		c.req.Header.Set("X-AppEngine-User-Is-Admin", "1")
+	} else {
+		c.req.Header.Set("X-AppEngine-User-Is-Admin", "0")
+	}
+}
+
+// Logout undoes Login.
+//
+// Logout is not part of the appengine.Context interface.
+func (c *Context) Logout() {
+	for _, key := range []string{"Email", "Id", "Is-Admin"} {
+		c.req.Header.Del("X-AppEngine-User-" + key)
+	}
+	c.req.Header.Del("X-AppEngine-Auth-Domain")
+}
+
+// CurrentNamespace sets the namespace of the API calls made with c, as
+// appengine.Namespace does for a derived context. The empty namespace is
+// the default one.
+//
+// CurrentNamespace is not part of the appengine.Context interface.
+func (c *Context) CurrentNamespace(namespace string) {
+	c.req.Header.Set("X-AppEngine-Current-Namespace", namespace)
+}
+
 // Options control optional behavior for NewContext.
 type Options struct {
 	// AppId to pretend to be. By default, "testapp"
@@ -180,6 +266,63 @@ type Options struct {
 	TaskQueues []string
 	Debug      string
 	DebugChild bool
+
+	// Env holds the application environment variables, as set by the
+	// env_variables section of app.yaml. They are also set in the
+	// environment of the test process while the Context is open, so
+	// Contexts with different values must not be open at the same time.
+	// The instance configuration read by the runtime of the test binary
+	// is set once, by appenginetestinit.Settings.Environ.
+	Env map[string]string
+
+	// AppYAML holds handlers, inbound services and environment variables
+	// merged into the generated app.yaml. It may name an existing
+	// app.yaml to merge in.
+	AppYAML *AppYAML
+
+	// AppDir is the root directory of the application under test. Its
+	// queue.yaml, cron.yaml, index.yaml and dispatch.yaml are used by
+	// the child dev_appserver.py and its app.yaml is merged into the
+	// generated one, unless AppYAML names another file.
+	AppDir string
+
+	// RequireIndexes makes datastore queries that need a composite index
+	// missing from index.yaml fail with an *IndexError, as they do in
+	// production.
+	RequireIndexes bool
+
+	// CronYAML is the path of the cron.yaml whose jobs are returned by
+	// Context.CronJobs. By default, the one of AppDir.
+	CronYAML string
+
+	// Consistency simulates the eventual consistency of the High
+	// Replication Datastore. By default, every query sees every write.
+	//
+	// The Puts made outside of transactions are acknowledged without
+	// reaching the child, so the errors it would return for them, such
+	// as an invalid key or an entity too large, are not returned by the
+	// Put but by the call that applies the write later, or not at all.
+	Consistency *Consistency
+
+	// Contention makes the commit of a datastore transaction fail with
+	// datastore.ErrConcurrentTransaction when another transaction or
+	// write changed one of its entity groups after it was first used.
+	Contention bool
+
+	// EnforceXG makes datastore transactions fail as they do in
+	// production when they use several entity groups without
+	// TransactionOptions.XG, or more than MaxXGEntityGroups with it.
+	EnforceXG bool
+
+	// ServiceAccount is the service account returned by
+	// appengine.ServiceAccount. By default, "<AppId>@appspot.gserviceaccount.com".
+	ServiceAccount string
+
+	// DefaultVersionHostname is the host name returned by
+	// appengine.DefaultVersionHostname, which reads it from the
+	// X-AppEngine-Default-Version-Hostname header of the request. By
+	// default, "<AppId>.appspot.com".
+	DefaultVersionHostname string
 }
 
 func (o *Options) appId() string {
@@ -210,6 +353,76 @@ func (o *Options) debugChild() bool {
 	return o.DebugChild
 }
 
+func (o *Options) env() map[string]string {
+	if o == nil {
+		return nil
+	}
+	return o.Env
+}
+
+func (o *Options) appYAML() *AppYAML {
+	if o == nil {
+		return nil
+	}
+	return o.AppYAML
+}
+
+func (o *Options) appDir() string {
+	if o == nil {
+		return ""
+	}
+	return o.AppDir
+}
+
+func (o *Options) requireIndexes() bool {
+	if o == nil {
+		return false
+	}
+	return o.RequireIndexes
+}
+
+func (o *Options) cronYAML() string {
+	if o == nil {
+		return ""
+	}
+	return o.CronYAML
+}
+
+func (o *Options) consistency() *Consistency {
+	if o == nil {
+		return nil
+	}
+	return o.Consistency
+}
+
+func (o *Options) contention() bool {
+	if o == nil {
+		return false
+	}
+	return o.Contention
+}
+
+func (o *Options) enforceXG() bool {
+	if o == nil {
+		return false
+	}
+	return o.EnforceXG
+}
+
+func (o *Options) serviceAccount() string {
+	if o == nil || o.ServiceAccount == "" {
+		return o.appId() + "@appspot.gserviceaccount.com"
+	}
+	return o.ServiceAccount
+}
+
+func (o *Options) defaultVersionHostname() string {
+	if o == nil || o.DefaultVersionHostname == "" {
+		return o.appId() + ".appspot.com"
+	}
+	return o.DefaultVersionHostname
+}
+
 func findFreePort() (int, error) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -247,7 +460,14 @@ func findDevAppserver() (string, error) {
 	return exec.LookPath("dev_appserver.py")
 }
 
-func (c *Context) startChild() error {
+// startChild starts the child dev_appserver.py process. On failure, the
+// temporary directories and any started child are cleaned up.
+func (c *Context) startChild() (err error) {
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
 
 	port, err := findFreePort()
 	if err != nil {
@@ -262,7 +482,7 @@ func (c *Context) startChild() error {
 	if err != nil {
 		return err
 	}
-	storageDir, err := ioutil.TempDir("", "gae-storage")
+	c.storageDir, err = ioutil.TempDir("", "gae-storage")
 	if err != nil {
 		return err
 	}
@@ -271,27 +491,54 @@ func (c *Context) startChild() error {
 		return err
 	}
 
+	if err = c.copyAppConfig(); err != nil {
+		return err
+	}
+	c.config, err = c.appYAMLSettings().merged(c.env)
+	if err != nil {
+		return err
+	}
+	if len(c.config.Ignored) > 0 {
+		log.Printf("appenginetesting: ignoring the app.yaml settings %s", strings.Join(c.config.Ignored, ", "))
+	}
+	if err = c.copyStaticFiles(); err != nil {
+		return err
+	}
+	config, err := c.config.config()
+	if err != nil {
+		return err
+	}
 	appYAMLBuf := new(bytes.Buffer)
-	appYAMLTempl.Execute(appYAMLBuf, struct {
+	err = appYAMLTempl.Execute(appYAMLBuf, struct {
 		AppId      string
 		APIVersion string
+		Config     []byte
 	}{
 		c.appid,
 		APIVersion,
+		config,
 	})
+	if err != nil {
+		return err
+	}
 	err = ioutil.WriteFile(filepath.Join(c.appDir, "app.yaml"), appYAMLBuf.Bytes(), 0755)
 	if err != nil {
 		return err
 	}
 
 	helperBuf := new(bytes.Buffer)
-	helperTempl.Execute(helperBuf, nil)
+	if err = helperTempl.Execute(helperBuf, nil); err != nil {
+		return err
+	}
 	err = ioutil.WriteFile(filepath.Join(c.appDir, "helper", "helper.go"), helperBuf.Bytes(), 0644)
 	if err != nil {
 		return err
 	}
 
 	devAppserver, err := findDevAppserver()
+	if err != nil {
+		return err
+	}
 
 	c.port = port
 	c.adminPort = adminPort
@@ -306,35 +553,36 @@ func (c *Context) startChild() error {
 	if Verbose {
 		log.Printf("OS: %s\n", runtime.GOOS)
 	}
+	args := []string{
+		"--clear_datastore=yes",
+		"--skip_sdk_update_check=yes",
+		fmt.Sprintf("--storage_path=%s", c.storageDir),
+		fmt.Sprintf("--port=%d", port),
+		fmt.Sprintf("--admin_port=%d", adminPort),
+		fmt.Sprintf("--log_level=%s", appLog),
+		fmt.Sprintf("--dev_appserver_log_level=%s", devServerLog),
+		// Eventual consistency is simulated by Context.Call.
+		"--datastore_consistency_policy=consistent",
+	}
+	if c.requireIndexes {
+		args = append(args, "--require_indexes=yes")
+	}
+	args = append(args, c.appDir)
+
+	// Set the environment first, so that a failure leaves no child
+	// running; the deferred Close restores it.
+	c.restoreEnv, err = appenginetestinit.Setenv(c.env)
+	if err != nil {
+		return err
+	}
+
 	switch runtime.GOOS {
 
 	case "windows":
-		c.child = exec.Command(
-			"cmd",
-			"/C",
-			devAppserver,
-			"--clear_datastore=yes",
-			"--skip_sdk_update_check=yes",
-			fmt.Sprintf("--storage_path=%s", storageDir),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--admin_port=%d", adminPort),
-			fmt.Sprintf("--log_level=%s", appLog),
-			fmt.Sprintf("--dev_appserver_log_level=%s", devServerLog),
-			c.appDir,
-		)
+		c.child = exec.Command("cmd", append([]string{"/C", devAppserver}, args...)...)
 
 	default:
-		c.child = exec.Command(
-			devAppserver,
-			"--clear_datastore=yes",
-			"--skip_sdk_update_check=yes",
-			fmt.Sprintf("--storage_path=%s", storageDir),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--admin_port=%d", adminPort),
-			fmt.Sprintf("--log_level=%s", appLog),
-			fmt.Sprintf("--dev_appserver_log_level=%s", devServerLog),
-			c.appDir,
-		)
+		c.child = exec.Command(devAppserver, args...)
 	}
 	if Verbose {
 		log.Println(c.child.Args)
@@ -382,21 +630,67 @@ func (c *Context) startChild() error {
 		return errors.New("timeout starting process")
 	case <-donec:
 	}
-
 	return nil
 }
 
+// newContext returns a Context for req configured from opts. The child
+// process is not started.
+func newContext(opts *Options, req *http.Request) *Context {
+	c := &Context{
+		appid:          opts.appId(),
+		hostname:       opts.defaultVersionHostname(),
+		closeOnce:      new(sync.Once),
+		req:            req,
+		queues:         opts.taskQueues(),
+		debug:          opts.debug(),
+		debugChild:     opts.debugChild(),
+		env:            opts.env(),
+		appYAML:        opts.appYAML(),
+		appRoot:        opts.appDir(),
+		requireIndexes: opts.requireIndexes(),
+		cronYAML:       opts.cronYAML(),
+		tracked:        newTracker(),
+		consistency:    newConsistency(opts.consistency()),
+		txns:           newTransactions(opts.contention(), opts.enforceXG()),
+		outbox:         new(Outbox),
+		urlfetch:       new(FetchStub),
+		channels:       newChannels(),
+		xmpp:           newXMPP(),
+		identity:       newIdentity(opts.serviceAccount()),
+		caps:           newCapabilities(),
+	}
+	c.setHeaders(req)
+	return c
+}
+
+// setHeaders adds to r the headers that the App Engine front end adds to
+// every request, unless r sets them already.
+func (c *Context) setHeaders(r *http.Request) {
+	if r == nil {
+		return
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	if r.Header.Get("X-AppEngine-Default-Version-Hostname") == "" {
+		r.Header.Set("X-AppEngine-Default-Version-Hostname", c.hostname)
+	}
+}
+
+// withRequest returns a copy of c that serves r while sharing the child
+// dev_appserver.py process of c.
+func (c *Context) withRequest(r *http.Request) *Context {
+	cc := *c
+	cc.req = r
+	cc.setHeaders(r)
+	return &cc
+}
+
 // NewContext returns a new AppEngine context with an empty datastore, etc.
 // A nil Options is valid and means to use the default values.
 func NewContext(opts *Options) (*Context, error) {
 	req, _ := http.NewRequest("GET", "/", nil)
-	c := &Context{
-		appid:      opts.appId(),
-		req:        req,
-		queues:     opts.taskQueues(),
-		debug:      opts.debug(),
-		debugChild: opts.debugChild(),
-	}
+	c := newContext(opts, req)
 	if err := c.startChild(); err != nil {
 		return nil, err
 	}
@@ -1,14 +1,26 @@
 package appenginetesting
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
 	"appengine/taskqueue"
 	"appengine/user"
+
+	"github.com/stanfy/gae-go-testing/appenginetestinit"
 )
 
+func init() {
+	appenginetestinit.Use()
+}
+
 type Entity struct {
 	Foo, Bar string
 }
@@ -171,3 +183,77 @@ func TestContext(t *testing.T) {
 		t.Fatalf("User IDs should be unique")
 	}
 }
+
+func TestEnv(t *testing.T) {
+	c, err := NewContext(&Options{Env: map[string]string{"APPENGINETESTING_STAGE": "test"}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+
+	if got := os.Getenv("APPENGINETESTING_STAGE"); got != "test" {
+		t.Errorf("got APPENGINETESTING_STAGE=%q; want %q", got, "test")
+	}
+	appYAML, err := ioutil.ReadFile(filepath.Join(c.appDir, "app.yaml"))
+	if err != nil {
+		t.Fatalf("reading app.yaml: %v", err)
+	}
+	if !strings.Contains(string(appYAML), "APPENGINETESTING_STAGE: test") {
+		t.Errorf("app.yaml has no env_variables entry:\n%s", appYAML)
+	}
+
+	c.Close()
+	if got := os.Getenv("APPENGINETESTING_STAGE"); got != "" {
+		t.Errorf("got APPENGINETESTING_STAGE=%q after Close; want it unset", got)
+	}
+}
+
+func TestCloseShared(t *testing.T) {
+	c := newContext(nil, nil)
+	restored := 0
+	c.restoreEnv = func() { restored++ }
+	cc := c.withRequest(nil)
+
+	cc.Close()
+	c.Close()
+	cc.Close()
+	if restored != 1 {
+		t.Errorf("environment restored %d times by closing a Context and its copy; want once", restored)
+	}
+}
+
+// TestRuntimeSettings checks that the runtime is configured with the
+// appenginetestinit settings, running itself again with settings in the
+// environment.
+func TestRuntimeSettings(t *testing.T) {
+	if os.Getenv("APPENGINE_TEST_VERSION_ID") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRuntimeSettings$", "-test.v")
+		cmd.Env = append(os.Environ(), "APPENGINE_TEST_VERSION_ID=2-beta", "APPENGINE_TEST_DATACENTER=us-test")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("TestRuntimeSettings with settings in the environment: %v\n%s", err, out)
+		}
+		return
+	}
+
+	s, err := appenginetestinit.LoadSettings()
+	if err != nil {
+		t.Fatalf("LoadSettings: %v", err)
+	}
+	c, err := NewContext(&Options{AppId: "settingsapp"})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if got := appengine.VersionID(c); got != s.VersionId {
+		t.Errorf("VersionID = %q; want %q", got, s.VersionId)
+	}
+	if got := appengine.Datacenter(); got != s.Datacenter {
+		t.Errorf("Datacenter = %q; want %q", got, s.Datacenter)
+	}
+	// The application ID is that of the Context, which the child
+	// dev_appserver.py serves.
+	if got := appengine.AppID(c); got != "settingsapp" {
+		t.Errorf("AppID = %q; want settingsapp", got)
+	}
+}
@@ -0,0 +1,423 @@
+package appenginetesting
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v1"
+)
+
+// CronJob is a job of cron.yaml.
+type CronJob struct {
+	URL         string `yaml:"url"`
+	Description string `yaml:"description"`
+	Schedule    string `yaml:"schedule"`
+	Timezone    string `yaml:"timezone"`
+	Target      string `yaml:"target"`
+
+	sched schedule
+	loc   *time.Location
+}
+
+// ParseCron parses the contents of a cron.yaml file.
+func ParseCron(data []byte) ([]*CronJob, error) {
+	var f struct {
+		Cron []*CronJob `yaml:"cron"`
+	}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, j := range f.Cron {
+		if j.URL == "" {
+			return nil, fmt.Errorf("cron job %q has no url", j.Description)
+		}
+		var err error
+		if j.sched, err = parseSchedule(j.Schedule); err != nil {
+			return nil, fmt.Errorf("cron job %s: %v", j.URL, err)
+		}
+		j.loc = time.UTC
+		if j.Timezone != "" {
+			if j.loc, err = time.LoadLocation(j.Timezone); err != nil {
+				return nil, fmt.Errorf("cron job %s: %v", j.URL, err)
+			}
+		}
+	}
+	return f.Cron, nil
+}
+
+// ReadCron parses the cron.yaml file at path.
+func ReadCron(path string) ([]*CronJob, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := ParseCron(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return jobs, nil
+}
+
+// Next returns the first time after t the job is scheduled to run, or
+// the zero Time if it never runs. For schedules such as "every 5
+// minutes", which App Engine counts from the end of the previous run, t
+// is taken as the end of the previous run.
+func (j *CronJob) Next(t time.Time) time.Time {
+	return j.sched.next(t.In(j.loc))
+}
+
+// Request returns the request App Engine sends to run the job.
+func (j *CronJob) Request() *http.Request {
+	req, _ := http.NewRequest("GET", j.URL, nil)
+	req.Header.Set("X-AppEngine-Cron", "true")
+	return req
+}
+
+// Run runs the job by serving its request with h.
+func (j *CronJob) Run(h http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, j.Request())
+	return w
+}
+
+// CronJobs returns the jobs of the cron.yaml given by Options.CronYAML,
+// or else of the one of Options.AppDir. It returns no jobs if there is
+// no cron.yaml.
+func (c *Context) CronJobs() ([]*CronJob, error) {
+	path := c.cronYAML
+	if path == "" && c.appRoot != "" {
+		path = filepath.Join(c.appRoot, "cron.yaml")
+		if !fileExists(path) {
+			return nil, nil
+		}
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return ReadCron(path)
+}
+
+// CronJob returns the job with the given description or URL.
+func (c *Context) CronJob(name string) (*CronJob, error) {
+	jobs, err := c.CronJobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if j.Description == name || j.URL == name {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("no cron job %q", name)
+}
+
+// RunCron runs the cron job with the given description or URL through
+// the harness and returns the recorded response.
+func (h *Harness) RunCron(name string) (*httptest.ResponseRecorder, error) {
+	j, err := h.c.CronJob(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.Do(j.Request()), nil
+}
+
+// schedule is a parsed cron schedule.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// intervalSchedule runs a job at a fixed interval, such as
+// "every 12 hours" or "every 5 minutes from 10:00 to 14:00".
+type intervalSchedule struct {
+	every    time.Duration
+	window   bool          // from and to are set
+	from, to time.Duration // since midnight
+}
+
+func (s *intervalSchedule) next(t time.Time) time.Time {
+	if !s.window {
+		return t.Add(s.every)
+	}
+	to := s.to
+	if to < s.from {
+		to += 24 * time.Hour
+	}
+	// Start from the day before, whose window may end after midnight.
+	day := midnight(t).AddDate(0, 0, -1)
+	for {
+		for d := s.from; d <= to; d += s.every {
+			if run := clock(day, d); run.After(t) {
+				return run
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+}
+
+// calendarSchedule runs a job on given days at a given time of day, such
+// as "every monday 09:00" or "2nd,third mon,wed of march 17:00".
+type calendarSchedule struct {
+	ordinals []int          // weeks of the month, 1 to 5; nil for every week
+	days     []int          // days of the month; nil for every day
+	weekdays []time.Weekday // nil for every day of the week
+	months   []time.Month   // nil for every month
+	at       time.Duration  // since midnight
+}
+
+func (s *calendarSchedule) next(t time.Time) time.Time {
+	day := midnight(t)
+	// Every schedule runs at least once in four years.
+	for i := 0; i < 4*366; i++ {
+		if s.matches(day) {
+			if run := clock(day, s.at); run.After(t) {
+				return run
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+func (s *calendarSchedule) matches(day time.Time) bool {
+	if s.months != nil && !containsMonth(s.months, day.Month()) {
+		return false
+	}
+	if s.days != nil && !containsInt(s.days, day.Day()) {
+		return false
+	}
+	if s.weekdays != nil && !containsWeekday(s.weekdays, day.Weekday()) {
+		return false
+	}
+	if s.ordinals != nil && !containsInt(s.ordinals, (day.Day()-1)/7+1) {
+		return false
+	}
+	return true
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// clock returns the time of day d after the midnight day, read on the
+// wall clock, so that a daylight saving time change in between does not
+// move it.
+func clock(day time.Time, d time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+func parseSchedule(sched string) (schedule, error) {
+	f := strings.Fields(strings.ToLower(sched))
+	if len(f) == 0 {
+		return nil, errors.New("empty schedule")
+	}
+	var (
+		s   schedule
+		err error
+	)
+	if n, nerr := strconv.Atoi(safeIndex(f, 1)); f[0] == "every" && nerr == nil {
+		s, err = parseInterval(n, f[2:])
+	} else {
+		s, err = parseCalendar(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", sched, err)
+	}
+	return s, nil
+}
+
+func parseInterval(n int, f []string) (*intervalSchedule, error) {
+	if n <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	s := new(intervalSchedule)
+	switch safeIndex(f, 0) {
+	case "hour", "hours":
+		s.every = time.Duration(n) * time.Hour
+	case "min", "mins", "minute", "minutes":
+		s.every = time.Duration(n) * time.Minute
+	default:
+		return nil, fmt.Errorf("unknown interval unit %q", safeIndex(f, 0))
+	}
+	f = f[1:]
+
+	var err error
+	switch {
+	case len(f) == 0:
+	case len(f) == 1 && f[0] == "synchronized":
+		s.window, s.from, s.to = true, 0, 24*time.Hour-time.Minute
+	case len(f) == 4 && f[0] == "from" && f[2] == "to":
+		s.window = true
+		if s.from, err = parseTimeOfDay(f[1]); err != nil {
+			return nil, err
+		}
+		if s.to, err = parseTimeOfDay(f[3]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %q", strings.Join(f, " "))
+	}
+	return s, nil
+}
+
+func parseCalendar(f []string) (*calendarSchedule, error) {
+	s := new(calendarSchedule)
+	var err error
+	if s.at, err = parseTimeOfDay(f[len(f)-1]); err != nil {
+		return nil, err
+	}
+	f = f[:len(f)-1]
+
+	// days of the month: "1,15 of month"
+	if days, derr := parseList(safeIndex(f, 0), parseDayOfMonth); derr == nil {
+		s.days = days
+		f = f[1:]
+		if safeIndex(f, 0) != "of" {
+			return nil, errors.New(`days of the month must be followed by "of"`)
+		}
+	} else {
+		// "every" or ordinals, then days of the week
+		if safeIndex(f, 0) != "every" {
+			if s.ordinals, err = parseList(safeIndex(f, 0), parseOrdinal); err != nil {
+				return nil, err
+			}
+		}
+		if len(f) < 2 {
+			return nil, errors.New("missing days")
+		}
+		if f[1] != "day" {
+			wds, err := parseList(f[1], parseWeekday)
+			if err != nil {
+				return nil, err
+			}
+			for _, wd := range wds {
+				s.weekdays = append(s.weekdays, time.Weekday(wd))
+			}
+		}
+		f = f[2:]
+	}
+
+	switch {
+	case len(f) == 0:
+	case len(f) == 2 && f[0] == "of":
+		if f[1] != "month" {
+			ms, err := parseList(f[1], parseMonth)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range ms {
+				s.months = append(s.months, time.Month(m))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %q", strings.Join(f, " "))
+	}
+	return s, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseList parses a comma separated list with parse.
+func parseList(s string, parse func(string) (int, error)) ([]int, error) {
+	if s == "" {
+		return nil, errors.New("empty list")
+	}
+	var l []int
+	for _, e := range strings.Split(s, ",") {
+		n, err := parse(e)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+func parseDayOfMonth(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 31 {
+		return 0, fmt.Errorf("invalid day of the month %q", s)
+	}
+	return n, nil
+}
+
+var ordinals = map[string]int{
+	"1st": 1, "first": 1,
+	"2nd": 2, "second": 2,
+	"3rd": 3, "third": 3,
+	"4th": 4, "fourth": 4,
+	"5th": 5, "fifth": 5,
+}
+
+func parseOrdinal(s string) (int, error) {
+	if n, ok := ordinals[s]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid ordinal %q", s)
+}
+
+func parseWeekday(s string) (int, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return int(d), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+func parseMonth(s string) (int, error) {
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		if s == name || s == name[:3] {
+			return int(m), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid month %q", s)
+}
+
+func safeIndex(f []string, i int) string {
+	if i < len(f) {
+		return f[i]
+	}
+	return ""
+}
+
+func containsInt(l []int, n int) bool {
+	for _, e := range l {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsWeekday(l []time.Weekday, d time.Weekday) bool {
+	for _, e := range l {
+		if e == d {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMonth(l []time.Month, m time.Month) bool {
+	for _, e := range l {
+		if e == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2014, time.January, 15, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		schedule string
+		want     time.Time
+	}{
+		{"every 5 minutes", now.Add(5 * time.Minute)},
+		{"every 12 hours", now.Add(12 * time.Hour)},
+		{"every 2 hours synchronized", time.Date(2014, time.January, 15, 12, 0, 0, 0, time.UTC)},
+		{"every 2 hours from 09:00 to 17:00", time.Date(2014, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"every 3 hours from 22:00 to 02:00", time.Date(2014, time.January, 15, 22, 0, 0, 0, time.UTC)},
+		{"every day 02:30", time.Date(2014, time.January, 16, 2, 30, 0, 0, time.UTC)},
+		{"every wednesday 11:00", time.Date(2014, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"every mon,fri 09:00", time.Date(2014, time.January, 17, 9, 0, 0, 0, time.UTC)},
+		{"1st monday of month 08:00", time.Date(2014, time.February, 3, 8, 0, 0, 0, time.UTC)},
+		{"2nd,third wed of march 17:00", time.Date(2014, time.March, 12, 17, 0, 0, 0, time.UTC)},
+		{"1,15 of month 10:00", time.Date(2014, time.February, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		jobs, err := ParseCron([]byte(fmt.Sprintf("cron:\n- url: /job\n  schedule: %s\n", tt.schedule)))
+		if err != nil {
+			t.Errorf("%q: %v", tt.schedule, err)
+			continue
+		}
+		if got := jobs[0].Next(now); !got.Equal(tt.want) {
+			t.Errorf("%q: got next run %v; want %v", tt.schedule, got, tt.want)
+		}
+	}
+
+	// Daylight saving time starts on March 9, 2014 in New York.
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	before := time.Date(2014, time.March, 8, 12, 0, 0, 0, ny)
+	for _, tt := range []struct {
+		schedule string
+		want     time.Time
+	}{
+		{"every day 09:00", time.Date(2014, time.March, 9, 9, 0, 0, 0, ny)},
+		{"every 2 hours from 08:00 to 10:00", time.Date(2014, time.March, 9, 8, 0, 0, 0, ny)},
+	} {
+		jobs, err := ParseCron([]byte(fmt.Sprintf("cron:\n- url: /job\n  schedule: %s\n  timezone: America/New_York\n", tt.schedule)))
+		if err != nil {
+			t.Errorf("%q: %v", tt.schedule, err)
+			continue
+		}
+		if got := jobs[0].Next(before); !got.Equal(tt.want) {
+			t.Errorf("%q across daylight saving time: got next run %v; want %v", tt.schedule, got.In(ny), tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "every 5 fortnights", "every tuesday", "every funday 10:00", "3 of month"} {
+		if _, err := ParseCron([]byte(fmt.Sprintf("cron:\n- url: /job\n  schedule: %q\n", bad))); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func TestCronJobs(t *testing.T) {
+	c := newContext(&Options{AppDir: "testdata"}, nil)
+	jobs, err := c.CronJobs()
+	if err != nil {
+		t.Fatalf("CronJobs: %v", err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("got %d jobs; want 3", len(jobs))
+	}
+
+	j, err := c.CronJob("monthly report")
+	if err != nil {
+		t.Fatalf("CronJob: %v", err)
+	}
+	now := time.Date(2014, time.January, 15, 10, 30, 0, 0, time.UTC)
+	ny, _ := time.LoadLocation("America/New_York")
+	if got, want := j.Next(now), time.Date(2014, time.February, 3, 8, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("got next run %v; want %v", got, want)
+	}
+
+	var cron string
+	w := j.Run(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cron = r.Header.Get("X-AppEngine-Cron")
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	if cron != "true" {
+		t.Errorf("got X-AppEngine-Cron %q; want %q", cron, "true")
+	}
+	if w.Body.String() != "/tasks/report" {
+		t.Errorf("got response %q; want %q", w.Body.String(), "/tasks/report")
+	}
+}
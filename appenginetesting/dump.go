@@ -0,0 +1,319 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// updateGolden is the -appenginetesting.update flag of the test binary,
+// which makes AssertDatastoreGolden rewrite the golden files.
+//
+// This deviates from the usual -update flag of golden tests: a package
+// registering -update would make every test package defining its own
+// -update flag panic at init. A boolean -update flag defined by the test
+// package is honored as well; see update.
+var updateGolden = flag.Bool("appenginetesting.update", false, "update the golden files of AssertDatastoreGolden")
+
+// update reports whether the golden files are to be rewritten: when the
+// test binary is run with -appenginetesting.update, or with -update if
+// the test package defines it.
+func update() bool {
+	if *updateGolden {
+		return true
+	}
+	f := flag.Lookup("update")
+	if f == nil {
+		return false
+	}
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	b, ok := g.Get().(bool)
+	return ok && b
+}
+
+// DumpDatastore returns every entity of every namespace of the datastore
+// in a stable, diffable text form. Entities are sorted by key and their
+// properties by name, like:
+//
+//	namespace ""
+//
+//	User,"alice"
+//	  Age: int64 30
+//	  Name: string "Alice"
+//
+//	User,"alice"/Comment,42
+//	  Body: string "Hello" noindex
+//
+// The writes delayed by Options.Consistency are applied first, as by
+// ApplyWrites, so they are all visible to later queries.
+func (c *Context) DumpDatastore() (string, error) {
+	namespaces, err := c.allEntities()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	for _, ns := range namespaces {
+		fmt.Fprintf(&buf, "namespace %q\n", ns.namespace)
+		for _, e := range ns.entities {
+			fmt.Fprintf(&buf, "\n%s\n", keyString(e.key))
+			props := append(datastore.PropertyList(nil), e.props...)
+			sort.Stable(byName(props))
+			for _, p := range props {
+				fmt.Fprintf(&buf, "  %s: %s", p.Name, dumpValue(p.Value))
+				if p.NoIndex {
+					buf.WriteString(" noindex")
+				}
+				buf.WriteString("\n")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+// namespaceEntities are the entities of a namespace, sorted by key.
+type namespaceEntities struct {
+	namespace string
+	entities  []dumpedEntity
+}
+
+type dumpedEntity struct {
+	key   *datastore.Key
+	props datastore.PropertyList
+}
+
+// allEntities returns the entities of every namespace, sorted by name.
+// The pending writes of Options.Consistency are applied first.
+func (c *Context) allEntities() ([]namespaceEntities, error) {
+	if err := c.ApplyWrites(); err != nil {
+		return nil, err
+	}
+	keys, err := datastore.NewQuery("__namespace__").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.StringID()
+	}
+	sort.Strings(names)
+
+	namespaces := make([]namespaceEntities, len(names))
+	for i, name := range names {
+		nc, err := appengine.Namespace(c, name)
+		if err != nil {
+			return nil, err
+		}
+		namespaces[i].namespace = name
+		if namespaces[i].entities, err = namespaceEntitiesOf(nc); err != nil {
+			return nil, fmt.Errorf("namespace %q: %v", name, err)
+		}
+	}
+	return namespaces, nil
+}
+
+// kinds returns the kinds of the namespace of c, except the special ones.
+func kinds(c appengine.Context) ([]string, error) {
+	keys, err := datastore.NewQuery("__kind__").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k.StringID(), "__") {
+			kinds = append(kinds, k.StringID())
+		}
+	}
+	return kinds, nil
+}
+
+func namespaceEntitiesOf(c appengine.Context) ([]dumpedEntity, error) {
+	kinds, err := kinds(c)
+	if err != nil {
+		return nil, err
+	}
+	var entities []dumpedEntity
+	for _, kind := range kinds {
+		var pls []datastore.PropertyList
+		keys, err := datastore.NewQuery(kind).GetAll(c, &pls)
+		if err != nil {
+			return nil, fmt.Errorf("kind %s: %v", kind, err)
+		}
+		for i, k := range keys {
+			entities = append(entities, dumpedEntity{k, pls[i]})
+		}
+	}
+	sort.Sort(byKey(entities))
+	return entities, nil
+}
+
+type byKey []dumpedEntity
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return keyLess(s[i].key, s[j].key) }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byName datastore.PropertyList
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// keyPath returns the keys of the path of k, from the root.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// keyLess orders keys the way the datastore does: by path, each element
+// by kind, then integer IDs before names.
+func keyLess(a, b *datastore.Key) bool {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		switch {
+		case x.Kind() != y.Kind():
+			return x.Kind() < y.Kind()
+		case x.StringID() == "" && y.StringID() != "":
+			return true
+		case x.StringID() != "" && y.StringID() == "":
+			return false
+		case x.IntID() != y.IntID():
+			return x.IntID() < y.IntID()
+		case x.StringID() != y.StringID():
+			return x.StringID() < y.StringID()
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+// keyString returns the path of k, such as User,"alice"/Comment,42.
+func keyString(k *datastore.Key) string {
+	var elems []string
+	for _, e := range keyPath(k) {
+		if e.StringID() != "" {
+			elems = append(elems, fmt.Sprintf("%s,%q", e.Kind(), e.StringID()))
+		} else {
+			elems = append(elems, fmt.Sprintf("%s,%d", e.Kind(), e.IntID()))
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+func dumpValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return "string " + strconv.Quote(v)
+	case int64:
+		return "int64 " + strconv.FormatInt(v, 10)
+	case float64:
+		return "float64 " + strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return "bool " + strconv.FormatBool(v)
+	case time.Time:
+		return "time " + v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return "bytes " + strconv.Quote(string(v))
+	case appengine.BlobKey:
+		return "blobkey " + strconv.Quote(string(v))
+	case appengine.GeoPoint:
+		return fmt.Sprintf("geopoint %v,%v", v.Lat, v.Lng)
+	case *datastore.Key:
+		if v.Namespace() != "" {
+			return fmt.Sprintf("key %q:%s", v.Namespace(), keyString(v))
+		}
+		return "key " + keyString(v)
+	}
+	return fmt.Sprintf("%T %v", v, v)
+}
+
+// AssertDatastoreGolden compares the DumpDatastore of c with the golden
+// file at path and reports the differences as test errors. When the test
+// binary is run with -appenginetesting.update, or with the -update flag of
+// the test package, if any, the golden file is written instead.
+func (c *Context) AssertDatastoreGolden(t testing.TB, path string) {
+	got, err := c.DumpDatastore()
+	if err != nil {
+		t.Fatalf("DumpDatastore: %v", err)
+	}
+
+	if update() {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("updating golden file: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("updating golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -appenginetesting.update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("datastore differs from %s (run with -appenginetesting.update to accept):\n%s",
+			path, lineDiff(strings.Split(string(want), "\n"), strings.Split(got, "\n")))
+	}
+}
+
+// lineDiff returns the lines of want missing from got prefixed with "-",
+// and those added in got prefixed with "+", around the common ones.
+func lineDiff(want, got []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// want[i:] and got[j:].
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			switch {
+			case want[i] == got[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(want) || j < len(got) {
+		switch {
+		case i < len(want) && j < len(got) && want[i] == got[j]:
+			fmt.Fprintf(&buf, "  %s\n", want[i])
+			i++
+			j++
+		case j < len(got) && (i == len(want) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&buf, "+ %s\n", got[j])
+			j++
+		default:
+			fmt.Fprintf(&buf, "- %s\n", want[i])
+			i++
+		}
+	}
+	return buf.String()
+}
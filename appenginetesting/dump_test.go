@@ -0,0 +1,47 @@
+package appenginetesting
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// updateFlag is the -update flag of the tests, which AssertDatastoreGolden
+// honors.
+var updateFlag = flag.Bool("update", false, "update the golden files")
+
+func TestDatastoreGolden(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.LoadFixtures("testdata/fixtures.yaml", "testdata/fixtures.json"); err != nil {
+		t.Fatalf("LoadFixtures: %v", err)
+	}
+	c.AssertDatastoreGolden(t, "testdata/fixtures.golden")
+}
+
+func TestUpdateFlag(t *testing.T) {
+	defer func(v bool) { *updateFlag = v }(*updateFlag)
+
+	*updateFlag = false
+	if update() {
+		t.Errorf("update() = true without -update")
+	}
+	if err := flag.Set("update", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if !update() {
+		t.Errorf("update() = false with the -update flag of the test package")
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	want := strings.Split("a\nb\nc\nd", "\n")
+	got := strings.Split("a\nc\nd\ne", "\n")
+	if diff, exp := lineDiff(want, got), "  a\n- b\n  c\n  d\n+ e\n"; diff != exp {
+		t.Errorf("got diff:\n%s\nwant:\n%s", diff, exp)
+	}
+}
@@ -0,0 +1,313 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v1"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// LoadFixtures puts the entities described by the given YAML (.yaml,
+// .yml) or JSON (.json) files into the datastore.
+//
+// A fixture file holds a list of entities such as:
+//
+//	# comments.yaml
+//	- kind: Comment
+//	  key: 42                   # string name or integer ID; omit to allocate an ID
+//	  parent:                   # ancestors, from the root
+//	  - {kind: User, key: alice}
+//	  namespace: acme           # optional
+//	  properties:
+//	    Body: Hello             # string, integer, float or boolean
+//	    Tags: [greeting, short] # multiple values
+//	    Posted: {time: "2014-01-02T15:04:05Z"}
+//	    Where: {geopoint: [48.85, 2.35]}
+//	    Photo: {blobkey: "AMIfv94..."}
+//	    Author: {key: {kind: User, key: alice}}
+//	    Thumbnail: {bytes: "iVBORw0KGgo="} # base64, not indexed
+//	    Text: {text: "A long text"}        # not indexed
+//	    Score: {float: 3}
+//
+// Key references are in the namespace of the entity.
+func (c *Context) LoadFixtures(paths ...string) error {
+	for _, path := range paths {
+		entities, err := readFixtures(path)
+		if err != nil {
+			return err
+		}
+		for i, e := range entities {
+			if err := c.putFixture(e); err != nil {
+				return fmt.Errorf("%s: entity %d: %v", path, i, err)
+			}
+		}
+	}
+	// Fixtures stand for data written long before the test.
+	return c.ApplyWrites()
+}
+
+// readFixtures returns the entities of a fixture file, with maps keyed by
+// strings and numbers as int64 or float64.
+func readFixtures(path string) ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &v)
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&v)
+	default:
+		return nil, fmt.Errorf("%s: unknown fixture format", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if v, err = normalizeFixture(v); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	list, ok := v.([]interface{})
+	if !ok && v != nil {
+		return nil, fmt.Errorf("%s: want a list of entities", path)
+	}
+	entities := make([]map[string]interface{}, len(list))
+	for i, e := range list {
+		if entities[i], ok = e.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s: entity %d is not a map", path, i)
+		}
+	}
+	return entities, nil
+}
+
+// normalizeFixture converts the values decoded from YAML or JSON to the
+// same types.
+func normalizeFixture(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", k)
+			}
+			var err error
+			if m[s], err = normalizeFixture(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case map[string]interface{}:
+		for k, e := range v {
+			var err error
+			if v[k], err = normalizeFixture(e); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = normalizeFixture(e); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case int:
+		return int64(v), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return v, nil
+}
+
+func (c *Context) putFixture(e map[string]interface{}) error {
+	var ac appengine.Context = c
+	if ns, ok := e["namespace"]; ok {
+		s, ok := ns.(string)
+		if !ok {
+			return fmt.Errorf("namespace %v is not a string", ns)
+		}
+		var err error
+		if ac, err = appengine.Namespace(c, s); err != nil {
+			return err
+		}
+	}
+
+	key, err := fixtureKey(ac, e, true)
+	if err != nil {
+		return err
+	}
+
+	props, ok := e["properties"].(map[string]interface{})
+	if !ok && e["properties"] != nil {
+		return errors.New("properties is not a map")
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pl datastore.PropertyList
+	for _, name := range names {
+		values, multiple := props[name].([]interface{})
+		if !multiple {
+			values = []interface{}{props[name]}
+		}
+		for _, v := range values {
+			p, err := fixtureProperty(ac, v)
+			if err != nil {
+				return fmt.Errorf("property %s: %v", name, err)
+			}
+			p.Name, p.Multiple = name, multiple
+			pl = append(pl, p)
+		}
+	}
+
+	_, err = datastore.Put(ac, key, &pl)
+	return err
+}
+
+// fixtureKey returns the key described by the kind, key and parent of e.
+// The key may be incomplete only if allowIncomplete is set.
+func fixtureKey(c appengine.Context, e map[string]interface{}, allowIncomplete bool) (*datastore.Key, error) {
+	var parent *datastore.Key
+	if ps, ok := e["parent"]; ok {
+		list, ok := ps.([]interface{})
+		if !ok {
+			list = []interface{}{ps}
+		}
+		for _, p := range list {
+			m, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("parent %v is not a map", p)
+			}
+			if _, ok := m["parent"]; ok {
+				return nil, errors.New("ancestors must all be listed in the parent of the entity")
+			}
+			k, err := fixtureKeyWithParent(c, m, parent, false)
+			if err != nil {
+				return nil, fmt.Errorf("parent: %v", err)
+			}
+			parent = k
+		}
+	}
+	return fixtureKeyWithParent(c, e, parent, allowIncomplete)
+}
+
+func fixtureKeyWithParent(c appengine.Context, e map[string]interface{}, parent *datastore.Key, allowIncomplete bool) (*datastore.Key, error) {
+	kind, ok := e["kind"].(string)
+	if !ok || kind == "" {
+		return nil, errors.New("missing kind")
+	}
+	switch id := e["key"].(type) {
+	case string:
+		return datastore.NewKey(c, kind, id, 0, parent), nil
+	case int64:
+		return datastore.NewKey(c, kind, "", id, parent), nil
+	case nil:
+		if allowIncomplete {
+			return datastore.NewIncompleteKey(c, kind, parent), nil
+		}
+		return nil, fmt.Errorf("missing key of %s", kind)
+	}
+	return nil, fmt.Errorf("key %v of %s is neither a string nor an integer", e["key"], kind)
+}
+
+// fixtureProperty returns the property holding the value v of a fixture.
+func fixtureProperty(c appengine.Context, v interface{}) (datastore.Property, error) {
+	switch v := v.(type) {
+	case nil, string, int64, float64, bool:
+		return datastore.Property{Value: v}, nil
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return datastore.Property{}, fmt.Errorf("typed value %v must have a single type", v)
+		}
+		for typ, x := range v {
+			value, err := fixtureTypedValue(c, typ, x)
+			noIndex := typ == "bytes" || typ == "text"
+			return datastore.Property{Value: value, NoIndex: noIndex}, err
+		}
+	}
+	return datastore.Property{}, fmt.Errorf("unsupported value %v", v)
+}
+
+func fixtureTypedValue(c appengine.Context, typ string, x interface{}) (interface{}, error) {
+	s, isString := x.(string)
+	switch typ {
+	case "time":
+		if !isString {
+			return nil, fmt.Errorf("time %v is not an RFC 3339 string", x)
+		}
+		return time.Parse(time.RFC3339, s)
+	case "geopoint":
+		ll, ok := x.([]interface{})
+		if !ok || len(ll) != 2 {
+			return nil, fmt.Errorf("geopoint %v is not a [lat, lng] pair", x)
+		}
+		lat, ok1 := fixtureFloat(ll[0])
+		lng, ok2 := fixtureFloat(ll[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("geopoint %v is not a [lat, lng] pair", x)
+		}
+		return appengine.GeoPoint{Lat: lat, Lng: lng}, nil
+	case "blobkey":
+		if !isString {
+			return nil, fmt.Errorf("blobkey %v is not a string", x)
+		}
+		return appengine.BlobKey(s), nil
+	case "key":
+		m, ok := x.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("key %v is not a map", x)
+		}
+		return fixtureKey(c, m, false)
+	case "bytes":
+		if !isString {
+			return nil, fmt.Errorf("bytes %v is not a base64 string", x)
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case "text":
+		if !isString {
+			return nil, fmt.Errorf("text %v is not a string", x)
+		}
+		return s, nil
+	case "float":
+		f, ok := fixtureFloat(x)
+		if !ok {
+			return nil, fmt.Errorf("float %v is not a number", x)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+func fixtureFloat(x interface{}) (float64, bool) {
+	switch x := x.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
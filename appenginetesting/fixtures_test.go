@@ -0,0 +1,86 @@
+package appenginetesting
+
+import (
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type User struct {
+	Name   string
+	Age    int64
+	Joined time.Time
+	Home   appengine.GeoPoint
+}
+
+type Comment struct {
+	Body   string
+	Tags   []string
+	Author *datastore.Key
+	Score  float64
+}
+
+func TestReadFixtures(t *testing.T) {
+	yamlEntities, err := readFixtures("testdata/fixtures.yaml")
+	if err != nil {
+		t.Fatalf("reading YAML fixtures: %v", err)
+	}
+	jsonEntities, err := readFixtures("testdata/fixtures.json")
+	if err != nil {
+		t.Fatalf("reading JSON fixtures: %v", err)
+	}
+	if len(yamlEntities) != 2 || len(jsonEntities) != 1 {
+		t.Fatalf("got %d YAML and %d JSON entities; want 2 and 1", len(yamlEntities), len(jsonEntities))
+	}
+	if id, ok := yamlEntities[1]["key"].(int64); !ok || id != 42 {
+		t.Errorf("got YAML key %#v; want int64 42", yamlEntities[1]["key"])
+	}
+	props := jsonEntities[0]["properties"].(map[string]interface{})
+	if age, ok := props["Age"].(int64); !ok || age != 41 {
+		t.Errorf("got JSON Age %#v; want int64 41", props["Age"])
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.LoadFixtures("testdata/fixtures.yaml", "testdata/fixtures.json"); err != nil {
+		t.Fatalf("LoadFixtures: %v", err)
+	}
+
+	var u User
+	alice := datastore.NewKey(c, "User", "alice", 0, nil)
+	if err := datastore.Get(c, alice, &u); err != nil {
+		t.Fatalf("getting alice: %v", err)
+	}
+	joined := time.Date(2014, time.January, 2, 15, 4, 5, 0, time.UTC)
+	if u.Name != "Alice" || u.Age != 30 || !u.Joined.Equal(joined) || u.Home.Lat != 48.85 {
+		t.Errorf("got user %+v", u)
+	}
+
+	var cm Comment
+	if err := datastore.Get(c, datastore.NewKey(c, "Comment", "", 42, alice), &cm); err != nil {
+		t.Fatalf("getting comment: %v", err)
+	}
+	if cm.Body != "Hello" || len(cm.Tags) != 2 || !cm.Author.Equal(alice) || cm.Score != 3 {
+		t.Errorf("got comment %+v", cm)
+	}
+
+	acme, err := appengine.Namespace(c, "acme")
+	if err != nil {
+		t.Fatalf("appengine.Namespace: %v", err)
+	}
+	var pl datastore.PropertyList
+	if err := datastore.Get(acme, datastore.NewKey(acme, "User", "bob", 0, nil), &pl); err != nil {
+		t.Fatalf("getting bob: %v", err)
+	}
+	if len(pl) != 4 {
+		t.Errorf("got properties %v; want 4", pl)
+	}
+}
@@ -0,0 +1,140 @@
+package appenginetesting
+
+import (
+	"appengine"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// Harness serves requests to an http.Handler against a single Context,
+// so that a sequence of requests (login, then post, then get) shares the
+// same datastore, memcache and task queues.
+type Harness struct {
+	Handler http.Handler
+
+	// App Engine request headers added to every request that does not
+	// set them already.
+	Country   string // X-AppEngine-Country
+	City      string // X-AppEngine-City
+	UserEmail string // X-AppEngine-User-Email
+	Admin     bool   // X-AppEngine-User-Is-Admin
+	Cron      bool   // X-AppEngine-Cron
+	QueueName string // X-AppEngine-QueueName
+
+	c *Context
+}
+
+// NewHarness starts a Context with the given options and returns a
+// Harness serving h against it.
+// A nil Options is valid and means to use the default values.
+func NewHarness(h http.Handler, opts *Options) (*Harness, error) {
+	c, err := NewContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{Handler: h, c: c}, nil
+}
+
+// Context returns the Context shared by all requests of the harness.
+func (h *Harness) Context() *Context {
+	return h.c
+}
+
+// Creator returns a function to be used by the handler in place of
+// appengine.NewContext. The returned contexts share the harness Context
+// but report the request they were created for.
+func (h *Harness) Creator() func(r *http.Request) appengine.Context {
+	return func(r *http.Request) appengine.Context {
+		return h.c.withRequest(r)
+	}
+}
+
+// Do adds the App Engine request headers to req, serves it with the
+// handler and returns the recorded response. The login and secure
+// settings of the app.yaml handler matching req are enforced first, and
+// blobs sent with blobstore.Send are served, the way the App Engine front
+// end does.
+func (h *Harness) Do(req *http.Request) *httptest.ResponseRecorder {
+	h.setHeaders(req)
+	w := httptest.NewRecorder()
+	if h.route(w, req) {
+		h.Handler.ServeHTTP(w, req)
+		if err := h.c.ServeBlob(w); err != nil {
+			w = httptest.NewRecorder()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	return w
+}
+
+// route applies the app.yaml handler settings to req and reports whether
+// it may be served by the handler. If not, the response is written to w.
+func (h *Harness) route(w http.ResponseWriter, req *http.Request) bool {
+	handler, err := h.c.config.handler(req.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if handler == nil {
+		return true
+	}
+
+	if handler.Secure == "always" && req.TLS == nil && req.URL.Scheme != "https" {
+		u := *req.URL
+		u.Scheme = "https"
+		if u.Host = req.Host; u.Host == "" {
+			u.Host = "localhost"
+		}
+		http.Redirect(w, req, u.String(), http.StatusFound)
+		return false
+	}
+
+	if handler.Login != "required" && handler.Login != "admin" {
+		return true
+	}
+	// Cron jobs and tasks may reach admin only URLs.
+	if req.Header.Get("X-AppEngine-Cron") == "true" || req.Header.Get("X-AppEngine-QueueName") != "" {
+		return true
+	}
+	if req.Header.Get("X-AppEngine-User-Email") == "" {
+		if handler.AuthFailAction == "unauthorized" {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, req, "/_ah/login?continue="+url.QueryEscape(req.URL.String()), http.StatusFound)
+		}
+		return false
+	}
+	if handler.Login == "admin" && req.Header.Get("X-AppEngine-User-Is-Admin") != "1" {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *Harness) setHeaders(req *http.Request) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	set := func(key, value string) {
+		if value != "" && req.Header.Get(key) == "" {
+			req.Header.Set(key, value)
+		}
+	}
+	set("X-AppEngine-Country", h.Country)
+	set("X-AppEngine-City", h.City)
+	set("X-AppEngine-User-Email", h.UserEmail)
+	if h.Admin {
+		set("X-AppEngine-User-Is-Admin", "1")
+	}
+	if h.Cron {
+		set("X-AppEngine-Cron", "true")
+	}
+	set("X-AppEngine-QueueName", h.QueueName)
+	h.c.setHeaders(req)
+}
+
+// Close kills the child dev_appserver.py process of the harness Context.
+func (h *Harness) Close() {
+	h.c.Close()
+}
@@ -0,0 +1,86 @@
+package appenginetesting
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestHarness(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/put", sampleHandler)
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		c := contextCreator(r)
+		var e Entity
+		if err := datastore.Get(c, datastore.NewKey(c, "Entity", "", 1, nil), &e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", e.Foo, r.Header.Get("X-AppEngine-Country"))
+	})
+
+	h, err := NewHarness(mux, nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+	defer h.Close()
+	contextCreator = h.Creator()
+	defer func() {
+		contextCreator = appengine.NewContext
+	}()
+	h.Country = "US"
+
+	r, _ := http.NewRequest("POST", "/put", nil)
+	if w := h.Do(r); w.Code != http.StatusOK {
+		t.Fatalf("got status %d; body: %q", w.Code, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/get", nil)
+	w := h.Do(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d; body: %q", w.Code, w.Body.String())
+	}
+	if got, want := w.Body.String(), "foo US"; got != want {
+		t.Errorf("got response %q; want %q", got, want)
+	}
+}
+
+func TestHarnessLogin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	})
+	h, err := NewHarness(ok, &Options{
+		AppYAML: &AppYAML{
+			Handlers: []*Handler{
+				{URL: "/admin/.*", Script: "_go_app", Login: "admin"},
+				{URL: "/account", Script: "_go_app", Login: "required", Secure: "always"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+	defer h.Close()
+
+	tests := []struct {
+		url, email string
+		admin      bool
+		code       int
+	}{
+		{"http://localhost/public", "", false, http.StatusOK},
+		{"http://localhost/account", "user@host.com", false, http.StatusFound},
+		{"https://localhost/account", "", false, http.StatusFound},
+		{"https://localhost/account", "user@host.com", false, http.StatusOK},
+		{"http://localhost/admin/stats", "user@host.com", false, http.StatusForbidden},
+		{"http://localhost/admin/stats", "admin@host.com", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		h.UserEmail, h.Admin = tt.email, tt.admin
+		r, _ := http.NewRequest("GET", tt.url, nil)
+		if w := h.Do(r); w.Code != tt.code {
+			t.Errorf("%s as %q: got status %d; want %d", tt.url, tt.email, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package appenginetesting
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine_internal"
+	identitypb "appengine_internal/app_identity"
+)
+
+// SigningKeyName is the name of the key returned by appengine.SignBytes.
+const SigningKeyName = "appenginetesting"
+
+// Identity answers the app_identity_service calls of the Contexts sharing
+// a child in process: appengine.ServiceAccount, AccessToken, SignBytes and
+// PublicCertificates. appengine.DefaultVersionHostname reads a request
+// header instead; see Options.DefaultVersionHostname.
+type Identity struct {
+	serviceAccount string
+
+	mu     sync.Mutex
+	tokens map[string]accessToken // by space-separated scopes
+	key    *rsa.PrivateKey
+	cert   *x509.Certificate
+}
+
+type accessToken struct {
+	token  string
+	expiry time.Time
+}
+
+func newIdentity(serviceAccount string) *Identity {
+	return &Identity{
+		serviceAccount: serviceAccount,
+		tokens:         make(map[string]accessToken),
+	}
+}
+
+// Identity returns the application identity of c.
+func (c *Context) Identity() *Identity {
+	return c.identity
+}
+
+// SetAccessToken makes appengine.AccessToken return token and expiry for
+// the scopes, in that order. Other scopes get a token naming them that
+// expires in an hour.
+func (id *Identity) SetAccessToken(token string, expiry time.Time, scopes ...string) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.tokens[strings.Join(scopes, " ")] = accessToken{token, expiry}
+}
+
+// SetKey makes appengine.SignBytes sign with key, and
+// appengine.PublicCertificates return cert. A nil cert is replaced by a
+// self-signed certificate of key, and a nil key by one generated on first
+// use, which then requires a nil cert.
+func (id *Identity) SetKey(key *rsa.PrivateKey, cert *x509.Certificate) error {
+	if key == nil && cert != nil {
+		return errors.New("appenginetesting: SetKey with a certificate but no key")
+	}
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.key, id.cert = key, cert
+	return nil
+}
+
+// Key returns the RSA key that appengine.SignBytes signs with, using
+// PKCS #1 v1.5 and SHA-256. Unless set by SetKey, it is generated on
+// first use.
+func (id *Identity) Key() (*rsa.PrivateKey, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if err := id.generateKey(); err != nil {
+		return nil, err
+	}
+	return id.key, nil
+}
+
+// Certificate returns the certificate that appengine.PublicCertificates
+// returns under SigningKeyName: the one given to SetKey, or a self-signed
+// certificate of Key.
+func (id *Identity) Certificate() (*x509.Certificate, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if err := id.generateKey(); err != nil {
+		return nil, err
+	}
+	return id.cert, nil
+}
+
+// generateKey generates the signing key and its certificate, unless
+// set. id.mu must be held.
+func (id *Identity) generateKey() error {
+	if id.key == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		id.key, id.cert = key, nil
+	}
+	if id.cert != nil {
+		return nil
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id.serviceAccount},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &id.key.PublicKey, id.key)
+	if err != nil {
+		return err
+	}
+	id.cert, err = x509.ParseCertificate(der)
+	return err
+}
+
+// fakeIdentity is the callHook answering the app_identity_service calls.
+func fakeIdentity(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "app_identity_service" {
+		return next()
+	}
+	id := c.identity
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	switch method {
+	case "GetServiceAccountName":
+		out.(*identitypb.GetServiceAccountNameResponse).ServiceAccountName = proto.String(id.serviceAccount)
+		return nil
+	case "GetAccessToken":
+		scopes := strings.Join(in.(*identitypb.GetAccessTokenRequest).Scope, " ")
+		t, ok := id.tokens[scopes]
+		if !ok {
+			t = accessToken{"token for " + scopes, time.Now().Add(time.Hour)}
+		}
+		res := out.(*identitypb.GetAccessTokenResponse)
+		res.AccessToken = proto.String(t.token)
+		res.ExpirationTime = proto.Int64(t.expiry.Unix())
+		return nil
+	case "SignForApp":
+		if err := id.generateKey(); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(in.(*identitypb.SignForAppRequest).BytesToSign)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, id.key, crypto.SHA256, sum[:])
+		if err != nil {
+			return err
+		}
+		res := out.(*identitypb.SignForAppResponse)
+		res.KeyName = proto.String(SigningKeyName)
+		res.SignatureBytes = sig
+		return nil
+	case "GetPublicCertificatesForApp":
+		if err := id.generateKey(); err != nil {
+			return err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.cert.Raw})
+		out.(*identitypb.GetPublicCertificateForAppResponse).PublicCertificateList = []*identitypb.PublicCertificate{{
+			KeyName:            proto.String(SigningKeyName),
+			X509CertificatePem: proto.String(string(data)),
+		}}
+		return nil
+	}
+	return next()
+}
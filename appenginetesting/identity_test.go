@@ -0,0 +1,122 @@
+package appenginetesting
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+
+	"appengine"
+)
+
+func TestIdentity(t *testing.T) {
+	c, err := NewContext(&Options{ServiceAccount: "robot@example.com"})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if got, err := appengine.ServiceAccount(c); err != nil || got != "robot@example.com" {
+		t.Errorf("ServiceAccount = %q, %v; want robot@example.com", got, err)
+	}
+	if got := appengine.DefaultVersionHostname(c); got != "testapp.appspot.com" {
+		t.Errorf("DefaultVersionHostname = %q; want testapp.appspot.com", got)
+	}
+
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	c.Identity().SetAccessToken("secret", expiry, "scope/a", "scope/b")
+	token, exp, err := appengine.AccessToken(c, "scope/a", "scope/b")
+	if err != nil || token != "secret" || !exp.Equal(expiry) {
+		t.Errorf("AccessToken = %q, %v, %v; want secret, %v", token, exp, err, expiry)
+	}
+
+	data := []byte("payload")
+	keyName, sig, err := appengine.SignBytes(c, data)
+	if err != nil {
+		t.Fatalf("SignBytes: %v", err)
+	}
+	certs, err := appengine.PublicCertificates(c)
+	if err != nil {
+		t.Fatalf("PublicCertificates: %v", err)
+	}
+	if len(certs) != 1 || certs[0].KeyName != keyName {
+		t.Fatalf("got certificates %+v; want one named %q", certs, keyName)
+	}
+	block, _ := pem.Decode(certs[0].Data)
+	if block == nil {
+		t.Fatalf("got certificate %q; want PEM", certs[0].Data)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestIdentitySetKey(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Identity().SetKey(key, nil); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+
+	data := []byte("payload")
+	_, sig, err := appengine.SignBytes(c, data)
+	if err != nil {
+		t.Fatalf("SignBytes: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature does not verify with the key given to SetKey: %v", err)
+	}
+	cert, err := c.Identity().Certificate()
+	if err != nil {
+		t.Fatalf("Certificate: %v", err)
+	}
+	if pub := cert.PublicKey.(*rsa.PublicKey); pub.N.Cmp(key.N) != 0 {
+		t.Errorf("certificate is not that of the key given to SetKey")
+	}
+
+	if err := c.Identity().SetKey(nil, cert); err == nil {
+		t.Errorf("SetKey with a certificate but no key succeeded")
+	}
+}
+
+func TestDefaultVersionHostnameHeader(t *testing.T) {
+	const header = "X-AppEngine-Default-Version-Hostname"
+	req, _ := http.NewRequest("GET", "/", nil)
+	c := newContext(&Options{DefaultVersionHostname: "v1.example.com"}, req)
+	if got := c.req.Header.Get(header); got != "v1.example.com" {
+		t.Errorf("got %s %q on the request of newContext; want v1.example.com", header, got)
+	}
+
+	r, _ := http.NewRequest("GET", "/page", nil)
+	c.withRequest(r)
+	if got := r.Header.Get(header); got != "v1.example.com" {
+		t.Errorf("got %s %q on the request of withRequest; want v1.example.com", header, got)
+	}
+
+	h := &Harness{c: c}
+	r, _ = http.NewRequest("GET", "/page", nil)
+	r.Header.Set(header, "other.example.com")
+	h.setHeaders(r)
+	if got := r.Header.Get(header); got != "other.example.com" {
+		t.Errorf("got %s %q after Harness.setHeaders; want the one of the request", header, got)
+	}
+}
@@ -0,0 +1,224 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine_internal"
+	imagepb "appengine_internal/image"
+)
+
+// fakeImages is the callHook answering the images service calls in
+// process, so that the child dev_appserver.py does not need the Python
+// Imaging Library. Images are decoded with the standard image packages
+// and resized with the nearest neighbor. Serving URLs are
+// http://localhost/_ah/img/<blob key>, or https for secure ones.
+//
+// The appengine/image package of the SDK only asks for serving URLs; it
+// has no function calling Transform, which is only reached by calling
+// Context.Call with an images.Transform request.
+func fakeImages(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "images" {
+		return next()
+	}
+	switch method {
+	case "Transform":
+		return c.transformImage(in.(*imagepb.ImagesTransformRequest), out.(*imagepb.ImagesTransformResponse))
+	case "GetUrlBase":
+		req := in.(*imagepb.ImagesGetUrlBaseRequest)
+		scheme := "http"
+		if req.GetCreateSecureUrl() {
+			scheme = "https"
+		}
+		out.(*imagepb.ImagesGetUrlBaseResponse).Url = proto.String(scheme + "://localhost/_ah/img/" + req.GetBlobKey())
+		return nil
+	case "DeleteUrlBase":
+		return nil
+	}
+	return imagesError(imagepb.ImagesServiceError_UNSPECIFIED_ERROR, "unsupported method "+method)
+}
+
+func (c *Context) transformImage(req *imagepb.ImagesTransformRequest, res *imagepb.ImagesTransformResponse) error {
+	data := req.Image.Content
+	if key := req.Image.GetBlobKey(); key != "" {
+		var err error
+		if data, err = ioutil.ReadAll(blobstore.NewReader(c, appengine.BlobKey(key))); err != nil {
+			return imagesError(imagepb.ImagesServiceError_INVALID_BLOB_KEY, err.Error())
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return imagesError(imagepb.ImagesServiceError_NOT_IMAGE, err.Error())
+	}
+
+	for _, t := range req.Transform {
+		if img, err = applyTransform(img, t); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	switch req.Output.GetMimeType() {
+	case imagepb.OutputSettings_PNG:
+		err = png.Encode(&buf, img)
+	case imagepb.OutputSettings_JPEG:
+		quality := int(req.Output.GetQuality())
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		return imagesError(imagepb.ImagesServiceError_BAD_TRANSFORM_DATA, fmt.Sprintf("unsupported output type %v", req.Output.GetMimeType()))
+	}
+	if err != nil {
+		return imagesError(imagepb.ImagesServiceError_UNSPECIFIED_ERROR, err.Error())
+	}
+	b := img.Bounds()
+	res.Image = &imagepb.ImageData{
+		Content: buf.Bytes(),
+		Width:   proto.Int32(int32(b.Dx())),
+		Height:  proto.Int32(int32(b.Dy())),
+	}
+	return nil
+}
+
+// applyTransform crops, resizes, rotates and flips img as t says, in
+// that order.
+func applyTransform(img image.Image, t *imagepb.Transform) (image.Image, error) {
+	b := img.Bounds()
+	if t.CropLeftX != nil || t.CropTopY != nil || t.CropRightX != nil || t.CropBottomY != nil {
+		left, top, right, bottom := t.GetCropLeftX(), t.GetCropTopY(), t.GetCropRightX(), t.GetCropBottomY()
+		if left < 0 || top < 0 || right > 1 || bottom > 1 || left >= right || top >= bottom {
+			return nil, imagesError(imagepb.ImagesServiceError_BAD_TRANSFORM_DATA, "invalid crop")
+		}
+		img = crop(img, image.Rect(
+			b.Min.X+int(left*float32(b.Dx())), b.Min.Y+int(top*float32(b.Dy())),
+			b.Min.X+int(right*float32(b.Dx())), b.Min.Y+int(bottom*float32(b.Dy())),
+		))
+	}
+
+	if w, h := int(t.GetWidth()), int(t.GetHeight()); w > 0 || h > 0 {
+		if w < 0 || h < 0 || w > 4000 || h > 4000 {
+			return nil, imagesError(imagepb.ImagesServiceError_BAD_TRANSFORM_DATA, "invalid resize")
+		}
+		img = resizeImage(img, w, h, t.GetCropToFit(), t.GetAllowStretch(), t.GetCropOffsetX(), t.GetCropOffsetY())
+	}
+
+	switch rot := t.GetRotate(); rot {
+	case 0:
+	case 90, 180, 270:
+		for i := int32(0); i < rot; i += 90 {
+			img = rotate90(img)
+		}
+	default:
+		return nil, imagesError(imagepb.ImagesServiceError_BAD_TRANSFORM_DATA, fmt.Sprintf("invalid rotation %d", rot))
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if t.GetHorizontalFlip() {
+		img = remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+	if t.GetVerticalFlip() {
+		img = remap(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	}
+	return img, nil
+}
+
+// resizeImage resizes img to fit in w by h, one of which may be 0, keeping
+// its aspect ratio unless stretch is set. With cropToFit, img is scaled to
+// cover w by h and cropped around the offsets, fractions of the width and
+// height.
+func resizeImage(img image.Image, w, h int, cropToFit, stretch bool, offsetX, offsetY float32) image.Image {
+	b := img.Bounds()
+	sx, sy := float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy())
+	switch {
+	case w == 0:
+		sx = sy
+	case h == 0:
+		sy = sx
+	case stretch:
+	case cropToFit:
+		if sx < sy {
+			sx = sy
+		} else {
+			sy = sx
+		}
+	default:
+		if sx < sy {
+			sy = sx
+		} else {
+			sx = sy
+		}
+	}
+	nw, nh := round(float64(b.Dx())*sx), round(float64(b.Dy())*sy)
+	scaled := remap(img, nw, nh, func(x, y int) (int, int) {
+		return minInt(int(float64(x)/sx), b.Dx()-1), minInt(int(float64(y)/sy), b.Dy()-1)
+	})
+	if !cropToFit || w == 0 || h == 0 {
+		return scaled
+	}
+	x := int(offsetX * float32(nw-w))
+	y := int(offsetY * float32(nh-h))
+	return crop(scaled, image.Rect(x, y, x+w, y+h))
+}
+
+func round(f float64) int {
+	if n := int(f + 0.5); n > 0 {
+		return n
+	}
+	return 1
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// rotate90 rotates img by 90 degrees clockwise.
+func rotate90(img image.Image) image.Image {
+	b := img.Bounds()
+	return remap(img, b.Dy(), b.Dx(), func(x, y int) (int, int) {
+		return y, b.Dy() - 1 - x
+	})
+}
+
+// remap returns a w by h image whose pixel at x, y is the pixel of img at
+// src(x, y), relative to the bounds of img.
+func remap(img image.Image, w, h int, src func(x, y int) (int, int)) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := src(x, y)
+			dst.Set(x, y, color.RGBAModel.Convert(img.At(b.Min.X+sx, b.Min.Y+sy)))
+		}
+	}
+	return dst
+}
+
+func crop(img image.Image, r image.Rectangle) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+func imagesError(code imagepb.ImagesServiceError_ErrorCode, detail string) error {
+	return &appengine_internal.APIError{
+		Service: "images",
+		Detail:  detail,
+		Code:    int32(code),
+	}
+}
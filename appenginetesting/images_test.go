@@ -0,0 +1,172 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	aeimage "appengine/image"
+	imagepb "appengine_internal/image"
+)
+
+func TestServingURL(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	u, err := aeimage.ServingURL(c, "photo", &aeimage.ServingURLOptions{Secure: true, Size: 32})
+	if err != nil {
+		t.Fatalf("ServingURL: %v", err)
+	}
+	if got, want := u.String(), "https://localhost/_ah/img/photo=s32"; got != want {
+		t.Errorf("got serving URL %q; want %q", got, want)
+	}
+	if err := aeimage.DeleteServingURL(c, "photo"); err != nil {
+		t.Errorf("DeleteServingURL: %v", err)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	tests := []struct {
+		w, h      int
+		cropToFit bool
+		stretch   bool
+		size      image.Point
+	}{
+		{10, 0, false, false, image.Pt(10, 5)},
+		{0, 10, false, false, image.Pt(20, 10)},
+		{10, 10, false, false, image.Pt(10, 5)},
+		{10, 10, true, false, image.Pt(10, 10)},
+		{10, 10, false, true, image.Pt(10, 10)},
+	}
+	for _, tt := range tests {
+		got := resizeImage(src, tt.w, tt.h, tt.cropToFit, tt.stretch, 0.5, 0.5).Bounds().Size()
+		if got != tt.size {
+			t.Errorf("resize to %dx%d (crop %v, stretch %v): got %v; want %v", tt.w, tt.h, tt.cropToFit, tt.stretch, got, tt.size)
+		}
+	}
+}
+
+func TestRotate90(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+	dst := rotate90(src)
+	if got := dst.Bounds().Size(); got != image.Pt(1, 2) {
+		t.Fatalf("got size %v; want 1x2", got)
+	}
+	// The left pixel ends up on top once rotated clockwise.
+	if got := color.RGBAModel.Convert(dst.At(0, 0)); got != red {
+		t.Errorf("got top pixel %v; want %v", got, red)
+	}
+}
+
+func TestTransformImage(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	// A 4x2 image, red on the left half and blue on the right one.
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if x < 2 {
+				src.Set(x, y, red)
+			} else {
+				src.Set(x, y, blue)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.CreateBlob("image/png", buf.Bytes())
+	if err != nil {
+		t.Fatalf("CreateBlob: %v", err)
+	}
+
+	transform := func(data *imagepb.ImageData, output imagepb.OutputSettings_MIME_TYPE, ts ...*imagepb.Transform) (image.Image, string) {
+		req := &imagepb.ImagesTransformRequest{
+			Image:     data,
+			Transform: ts,
+			Output:    &imagepb.OutputSettings{MimeType: &output},
+		}
+		res := &imagepb.ImagesTransformResponse{}
+		if err := c.Call("images", "Transform", req, res, nil); err != nil {
+			t.Fatalf("Transform: %v", err)
+		}
+		img, format, err := image.Decode(bytes.NewReader(res.Image.Content))
+		if err != nil {
+			t.Fatalf("decoding the transformed image: %v", err)
+		}
+		if b := img.Bounds(); int32(b.Dx()) != res.Image.GetWidth() || int32(b.Dy()) != res.Image.GetHeight() {
+			t.Errorf("got a %v image; the response says %dx%d", b.Size(), res.Image.GetWidth(), res.Image.GetHeight())
+		}
+		return img, format
+	}
+	// checkPixels checks the first row of img.
+	checkPixels := func(name string, img image.Image, want ...color.RGBA) {
+		for x, w := range want {
+			if got := color.RGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y)); got != w {
+				t.Errorf("%s: got pixel %d %v; want %v", name, x, got, w)
+			}
+		}
+	}
+
+	// The right three quarters, flipped.
+	img, format := transform(&imagepb.ImageData{Content: buf.Bytes()}, imagepb.OutputSettings_PNG,
+		&imagepb.Transform{CropLeftX: proto.Float32(0.25), HorizontalFlip: proto.Bool(true)})
+	if format != "png" {
+		t.Errorf("crop and flip: got %s output; want png", format)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(3, 2) {
+		t.Errorf("crop and flip: got size %v; want 3x2", got)
+	}
+	checkPixels("crop and flip", img, blue, blue, red)
+
+	// Resized from the blob to half its size.
+	img, _ = transform(&imagepb.ImageData{BlobKey: proto.String(string(key))}, imagepb.OutputSettings_PNG,
+		&imagepb.Transform{Width: proto.Int32(2)})
+	if got := img.Bounds().Size(); got != image.Pt(2, 1) {
+		t.Errorf("resize: got size %v; want 2x1", got)
+	}
+	checkPixels("resize", img, red, blue)
+
+	img, format = transform(&imagepb.ImageData{Content: buf.Bytes()}, imagepb.OutputSettings_JPEG,
+		&imagepb.Transform{Rotate: proto.Int32(90)})
+	if format != "jpeg" {
+		t.Errorf("rotate: got %s output; want jpeg", format)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(2, 4) {
+		t.Fatalf("rotate: got size %v; want 2x4", got)
+	}
+	// Rotated clockwise, the red left half ends up on top. JPEG is lossy,
+	// so the colors are compared with some tolerance.
+	near := func(a, b color.RGBA) bool {
+		d := func(x, y uint8) bool { return int(x)-int(y) <= 16 && int(y)-int(x) <= 16 }
+		return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B)
+	}
+	for y := 0; y < 4; y++ {
+		want := red
+		if y >= 2 {
+			want = blue
+		}
+		for x := 0; x < 2; x++ {
+			got := color.RGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y)).(color.RGBA)
+			if !near(got, want) {
+				t.Errorf("rotate: got pixel %d,%d %v; want about %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package appenginetesting
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// IndexError is returned for a datastore query that needs a composite
+// index missing from index.yaml, when Options.RequireIndexes is set.
+type IndexError struct {
+	// Index is the index.yaml definition of the missing index.
+	Index string
+}
+
+func (e *IndexError) Error() string {
+	return "no matching index found; add this index to index.yaml:\n" + e.Index
+}
+
+// needIndex is in the error of a query missing an index, as the helper
+// reports it.
+const needIndex = "(datastore_v3: NEED_INDEX)"
+
+// indexMarkers precede the definition of the missing index in the errors
+// of dev_appserver.py and of production.
+var indexMarkers = []string{
+	"The following index is the minimum index required:",
+	"The suggested index for this query is:",
+}
+
+// indexError returns the *IndexError reported by an error body of the
+// helper, or nil if body reports another error.
+func indexError(body []byte) error {
+	msg := string(body)
+	if !strings.Contains(msg, needIndex) {
+		return nil
+	}
+	for _, marker := range indexMarkers {
+		if i := strings.Index(msg, marker); i >= 0 {
+			return &IndexError{Index: strings.TrimSpace(msg[i+len(marker):]) + "\n"}
+		}
+	}
+	return &IndexError{}
+}
+
+// GeneratedIndexYAML returns the index.yaml of the child dev_appserver.py,
+// including the indexes it generated for the queries run so far, so that
+// it can be compared with the committed file. It must be called before
+// Close.
+func (c *Context) GeneratedIndexYAML() ([]byte, error) {
+	path := filepath.Join(c.appDir, "index.yaml")
+	if !fileExists(path) {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,49 @@
+package appenginetesting
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+)
+
+func TestRequireIndexes(t *testing.T) {
+	c, err := NewContext(&Options{RequireIndexes: true})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	q := datastore.NewQuery("Entity").Filter("Foo =", "foo").Order("-Bar")
+	var es []Entity
+	_, err = q.GetAll(c, &es)
+	ierr, ok := err.(*IndexError)
+	if !ok {
+		t.Fatalf("got error %v; want an *IndexError", err)
+	}
+	for _, s := range []string{"kind: Entity", "name: Foo", "name: Bar", "direction: desc"} {
+		if !strings.Contains(ierr.Index, s) {
+			t.Errorf("suggested index %q does not contain %q", ierr.Index, s)
+		}
+	}
+}
+
+func TestIndexError(t *testing.T) {
+	// The error body of the helper for the query of TestRequireIndexes.
+	body, err := ioutil.ReadFile("testdata/need_index.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ierr, ok := indexError(body).(*IndexError)
+	if !ok {
+		t.Fatalf("got error %v; want an *IndexError", indexError(body))
+	}
+	want := "- kind: Entity\n  properties:\n  - name: Foo\n  - name: Bar\n    direction: desc\n"
+	if ierr.Index != want {
+		t.Errorf("got index %q; want %q", ierr.Index, want)
+	}
+	if indexError([]byte("API error 1 (datastore_v3: BAD_REQUEST): no matching index found")) != nil {
+		t.Errorf("got an *IndexError for an unrelated error")
+	}
+}
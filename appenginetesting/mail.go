@@ -0,0 +1,274 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine/mail"
+	"appengine_internal"
+	mailpb "appengine_internal/mail"
+)
+
+// SentMail is a mail sent by the application with mail.Send or
+// mail.SendToAdmins.
+type SentMail struct {
+	mail.Message
+	ToAdmins bool // sent with mail.SendToAdmins
+}
+
+// Outbox holds the mails sent through the Contexts sharing a child. The
+// child dev_appserver.py only logs them.
+type Outbox struct {
+	mu    sync.Mutex
+	mails []*SentMail
+}
+
+// Mail returns the outbox of c.
+func (c *Context) Mail() *Outbox {
+	return c.outbox
+}
+
+// Messages returns the mails sent so far, in order.
+func (o *Outbox) Messages() []*SentMail {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*SentMail(nil), o.mails...)
+}
+
+// Find returns the mails sent to the address to, as a To, Cc or Bcc
+// recipient, whose subject matches the regular expression subject. An
+// empty to matches every mail, including those sent to the admins.
+func (o *Outbox) Find(to, subject string) []*SentMail {
+	re := regexp.MustCompile(subject)
+	var found []*SentMail
+	for _, m := range o.Messages() {
+		if (to == "" || m.sentTo(to)) && re.MatchString(m.Subject) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Clear empties the outbox.
+func (o *Outbox) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.mails = nil
+}
+
+// sentTo reports whether addr is a recipient of m.
+func (m *SentMail) sentTo(addr string) bool {
+	addr = mailAddress(addr)
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, r := range list {
+			if mailAddress(r) == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mailAddress returns the lowercase address of s, which may also hold a
+// display name, such as "Gopher <gopher@example.com>".
+func mailAddress(s string) string {
+	if a, err := netmail.ParseAddress(s); err == nil {
+		s = a.Address
+	}
+	return strings.ToLower(s)
+}
+
+// captureMail is the callHook adding the mails sent to the outbox.
+func captureMail(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "mail" || (method != "Send" && method != "SendToAdmins") {
+		return next()
+	}
+	if err := next(); err != nil {
+		return err
+	}
+	m := sentMail(in.(*mailpb.MailMessage))
+	m.ToAdmins = method == "SendToAdmins"
+	c.outbox.mu.Lock()
+	c.outbox.mails = append(c.outbox.mails, m)
+	c.outbox.mu.Unlock()
+	return nil
+}
+
+// sentMail decodes the message of a Send or SendToAdmins call.
+func sentMail(msg *mailpb.MailMessage) *SentMail {
+	m := &SentMail{Message: mail.Message{
+		Sender:   msg.GetSender(),
+		ReplyTo:  msg.GetReplyTo(),
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		Subject:  msg.GetSubject(),
+		Body:     msg.GetTextBody(),
+		HTMLBody: msg.GetHtmlBody(),
+	}}
+	for _, a := range msg.Attachment {
+		m.Attachments = append(m.Attachments, mail.Attachment{
+			Name:      a.GetFileName(),
+			Data:      a.Data,
+			ContentID: a.GetContentID(),
+		})
+	}
+	if len(msg.Header) > 0 {
+		m.Headers = make(netmail.Header)
+		for _, h := range msg.Header {
+			name := textproto.CanonicalMIMEHeaderKey(h.GetName())
+			m.Headers[name] = append(m.Headers[name], h.GetValue())
+		}
+	}
+	return m
+}
+
+// DeliverMail delivers msg to the handler h the way App Engine delivers
+// inbound mail: for each recipient address, the message is POSTed in MIME
+// form to /_ah/mail/<address>. The responses are returned in the order
+// of the To, Cc and Bcc recipients.
+func (c *Context) DeliverMail(h http.Handler, msg *mail.Message) ([]*httptest.ResponseRecorder, error) {
+	var recipients []string
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		recipients = append(recipients, list...)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("mail has no recipient")
+	}
+	body, err := mimeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []*httptest.ResponseRecorder
+	for _, to := range recipients {
+		req, err := http.NewRequest("POST", "/_ah/mail/"+mailAddress(to), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "message/rfc822")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		responses = append(responses, w)
+	}
+	return responses, nil
+}
+
+// mimeMessage returns msg in the MIME form read by net/mail. A message
+// with an HTML body or attachments is multipart.
+func mimeMessage(msg *mail.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", msg.Sender)
+	if len(msg.To) > 0 {
+		header("To", strings.Join(msg.To, ", "))
+	}
+	if len(msg.Cc) > 0 {
+		header("Cc", strings.Join(msg.Cc, ", "))
+	}
+	if msg.ReplyTo != "" {
+		header("Reply-To", msg.ReplyTo)
+	}
+	header("Subject", mimeWord(msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	for name, values := range msg.Headers {
+		for _, v := range values {
+			header(name, v)
+		}
+	}
+	header("MIME-Version", "1.0")
+
+	if msg.HTMLBody == "" && len(msg.Attachments) == 0 {
+		header("Content-Type", "text/plain; charset=UTF-8")
+		buf.WriteString("\r\n")
+		buf.WriteString(msg.Body)
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+
+	var alt bytes.Buffer
+	aw := multipart.NewWriter(&alt)
+	if err := writeTextPart(aw, "text/plain", msg.Body); err != nil {
+		return nil, err
+	}
+	if msg.HTMLBody != "" {
+		if err := writeTextPart(aw, "text/html", msg.HTMLBody); err != nil {
+			return nil, err
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + aw.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pw.Write(alt.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, a := range msg.Attachments {
+		h := textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Name)},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if a.ContentID != "" {
+			h.Set("Content-ID", a.ContentID)
+		}
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		for len(enc) > 76 {
+			fmt.Fprintf(pw, "%s\r\n", enc[:76])
+			enc = enc[76:]
+		}
+		fmt.Fprintf(pw, "%s\r\n", enc)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write([]byte(text))
+	return err
+}
+
+// mimeWord encodes s as an RFC 2047 encoded-word if it is not ASCII.
+func mimeWord(s string) string {
+	for _, r := range s {
+		if r >= 0x80 {
+			return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(s)) + "?="
+		}
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	netmail "net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine/mail"
+)
+
+func TestMailOutbox(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	msg := &mail.Message{
+		Sender:  "noreply@testapp.appspotmail.com",
+		To:      []string{"Gopher <gopher@example.com>"},
+		Subject: "Confirm your registration",
+		Body:    "Click the link.",
+		Attachments: []mail.Attachment{
+			{Name: "terms.txt", Data: []byte("Be nice.")},
+		},
+	}
+	if err := mail.Send(c, msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := mail.SendToAdmins(c, &mail.Message{Sender: msg.Sender, Subject: "New user", Body: "gopher"}); err != nil {
+		t.Fatalf("SendToAdmins: %v", err)
+	}
+
+	found := c.Mail().Find("GOPHER@example.com", "^Confirm")
+	if len(found) != 1 {
+		t.Fatalf("found %d confirmation mails; want 1", len(found))
+	}
+	if m := found[0]; m.Body != msg.Body || len(m.Attachments) != 1 || string(m.Attachments[0].Data) != "Be nice." {
+		t.Errorf("got mail %+v; want %+v", m.Message, msg)
+	}
+	if found := c.Mail().Find("", "New user"); len(found) != 1 || !found[0].ToAdmins {
+		t.Errorf("got admin mails %v; want one", found)
+	}
+
+	c.Mail().Clear()
+	if n := len(c.Mail().Messages()); n != 0 {
+		t.Errorf("got %d mails after Clear; want 0", n)
+	}
+}
+
+func TestDeliverMail(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	var paths []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		m, err := netmail.ReadMessage(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(m.Body)
+		fmt.Fprintf(w, "%s|%s", m.Header.Get("Subject"), body)
+	})
+	ws, err := c.DeliverMail(h, &mail.Message{
+		Sender:  "customer@example.com",
+		To:      []string{"Support <support@testapp.appspotmail.com>"},
+		Cc:      []string{"sales@testapp.appspotmail.com"},
+		Subject: "Help",
+		Body:    "It does not work.",
+	})
+	if err != nil {
+		t.Fatalf("DeliverMail: %v", err)
+	}
+	want := []string{"/_ah/mail/support@testapp.appspotmail.com", "/_ah/mail/sales@testapp.appspotmail.com"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got paths %q; want %q", paths, want)
+	}
+	for _, w := range ws {
+		if got := w.Body.String(); w.Code != http.StatusOK || got != "Help|It does not work." {
+			t.Errorf("got response %d %q", w.Code, got)
+		}
+	}
+}
+
+func TestMimeMessageMultipart(t *testing.T) {
+	data, err := mimeMessage(&mail.Message{
+		Sender:      "customer@example.com",
+		To:          []string{"support@testapp.appspotmail.com"},
+		Subject:     "Écran",
+		Body:        "text",
+		HTMLBody:    "<b>html</b>",
+		Attachments: []mail.Attachment{{Name: "log.txt", Data: []byte("log")}},
+	})
+	if err != nil {
+		t.Fatalf("mimeMessage: %v", err)
+	}
+	m, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got Content-Type %q; want multipart/mixed", m.Header.Get("Content-Type"))
+	}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		parts = append(parts, p.Header.Get("Content-Type"))
+	}
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "multipart/alternative") || parts[1] != "application/octet-stream" {
+		t.Errorf("got parts %q; want the alternative bodies and the attachment", parts)
+	}
+}
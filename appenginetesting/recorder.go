@@ -3,28 +3,53 @@ package appenginetesting
 import (
 	"appengine"
 	"net/http"
+	"sync"
 )
 
+// ContextRecorder creates Contexts for the requests served by a handler
+// under test and records them for later inspection. All the Contexts it
+// creates share a single child dev_appserver.py process, started for the
+// first request.
 type ContextRecorder struct {
-	c       *Context
+	opts    *Options
 	creator func(r *http.Request) appengine.Context
+
+	mu       sync.Mutex
+	c        *Context // shared by all requests; holds the child process
+	err      error    // error starting the child, if any
+	requests []*http.Request
+	contexts []*Context
 }
 
 func NewContextRecorder(opts *Options) *ContextRecorder {
 
-	recorder := new(ContextRecorder)
+	recorder := &ContextRecorder{opts: opts}
 
 	creator := func(r *http.Request) appengine.Context {
-		recorder.c = &Context{
-			appid: opts.appId(),
-			req:   r,
-		}
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
 
-		if err := recorder.c.startChild(); err != nil {
-			panic(err.Error())
+		var c *Context
+		if recorder.c == nil {
+			c = newContext(recorder.opts, r)
+			if err := c.startChild(); err != nil {
+				// Leave recorder.c nil so that the next request tries
+				// again.
+				recorder.err = err
+				c.err = err
+				c.Errorf("starting child: %v", err)
+			} else {
+				recorder.err = nil
+				recorder.c = c
+				currentContext = c
+			}
 		}
-
-		return recorder.c
+		if recorder.c != nil {
+			c = recorder.c.withRequest(r)
+		}
+		recorder.requests = append(recorder.requests, r)
+		recorder.contexts = append(recorder.contexts, c)
+		return c
 	}
 
 	recorder.creator = creator
@@ -36,6 +61,45 @@ func (r *ContextRecorder) Creator() func(r *http.Request) appengine.Context {
 	return r.creator
 }
 
+// Context returns the Context created for the last request, or nil if
+// no request has been served yet.
 func (r *ContextRecorder) Context() *Context {
-	return r.c
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.contexts) == 0 {
+		return nil
+	}
+	return r.contexts[len(r.contexts)-1]
+}
+
+// Requests returns every request a Context was created for, in order.
+func (r *ContextRecorder) Requests() []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request(nil), r.requests...)
+}
+
+// Contexts returns every Context created, in the order of Requests.
+func (r *ContextRecorder) Contexts() []*Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Context(nil), r.contexts...)
+}
+
+// Err returns the error that occurred the last time the child process
+// failed to start, if it is not running. The Context created for the
+// request that failed returns that error from all its API calls; the
+// next request tries to start the child again.
+func (r *ContextRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close kills the child dev_appserver.py process shared by the recorded
+// Contexts.
+func (r *ContextRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.c.Close()
 }
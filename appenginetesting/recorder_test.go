@@ -47,9 +47,61 @@ func TestHandler(t *testing.T) {
 	c := recorder.Context()
 	k := datastore.NewKey(c, "Entity", "", 1, nil)
 	if err := datastore.Get(c, k, &e); err != nil {
-		t.Errorf(err.Error())
+		t.Errorf("datastore.Get: %v", err)
 	}
 	if e.Foo != "foo" || e.Bar != "bar" {
 		t.Errorf("got response %v ; want %v", e, Entity{Foo: "foo", Bar: "bar"})
 	}
 }
+
+func TestRecorderSharesChild(t *testing.T) {
+	recorder := NewContextRecorder(&Options{AppId: "recorderapp"})
+	contextCreator = recorder.Creator()
+	defer recorder.Close()
+	defer func() {
+		contextCreator = appengine.NewContext
+	}()
+
+	for _, path := range []string{"/first", "/second"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		sampleHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d; body: %q", path, w.Code, w.Body.String())
+		}
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("recorder.Err() = %v", err)
+	}
+
+	reqs, ctxs := recorder.Requests(), recorder.Contexts()
+	if len(reqs) != 2 || len(ctxs) != 2 {
+		t.Fatalf("got %d requests and %d contexts; want 2 of each", len(reqs), len(ctxs))
+	}
+	if got := ctxs[1].Request().(*http.Request).URL.Path; got != "/second" {
+		t.Errorf("got request path %q; want %q", got, "/second")
+	}
+	if ctxs[0].port != ctxs[1].port {
+		t.Errorf("contexts use different children on ports %d and %d", ctxs[0].port, ctxs[1].port)
+	}
+	if got := ctxs[0].AppID(); got != "recorderapp" {
+		t.Errorf("got AppID %q; want %q", got, "recorderapp")
+	}
+}
+
+func TestRecorderStartError(t *testing.T) {
+	recorder := NewContextRecorder(&Options{AppYAML: &AppYAML{File: "testdata/missing/app.yaml"}})
+	defer recorder.Close()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	c := recorder.Creator()(r)
+	if recorder.Err() == nil {
+		t.Fatalf("recorder.Err() = nil; want the error starting the child")
+	}
+	if err := c.Call("datastore_v3", "Get", nil, nil, nil); err != recorder.Err() {
+		t.Errorf("Call returned %v; want the error starting the child", err)
+	}
+	if recorder.c != nil {
+		t.Errorf("recorder kept the Context that failed to start")
+	}
+}
@@ -0,0 +1,48 @@
+package appenginetesting
+
+import (
+	"appengine/search"
+)
+
+// The search API calls of appengine/search go through Context.Call to
+// the search stub of the child dev_appserver.py, like the other services.
+
+// SearchDocumentIDs returns the IDs of the documents of the search index
+// with the given name, in order.
+func (c *Context) SearchDocumentIDs(index string) ([]string, error) {
+	x, err := search.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for t := x.List(c, &search.ListOptions{IDsOnly: true}); ; {
+		id, err := t.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ClearSearchIndex deletes every document of the search index with the
+// given name.
+func (c *Context) ClearSearchIndex(index string) error {
+	ids, err := c.SearchDocumentIDs(index)
+	if err != nil {
+		return err
+	}
+	x, err := search.Open(index)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := x.Delete(c, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
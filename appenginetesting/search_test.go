@@ -0,0 +1,77 @@
+package appenginetesting
+
+import (
+	"reflect"
+	"testing"
+
+	"appengine/search"
+)
+
+type Product struct {
+	Name        string
+	Description search.HTML
+}
+
+func TestSearch(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	index, err := search.Open("products")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	products := map[string]*Product{
+		"gopher": {Name: "Gopher plush", Description: "<b>Soft</b> gopher"},
+		"mug":    {Name: "Mug", Description: "A gopher mug"},
+		"shirt":  {Name: "T-shirt", Description: "Plain"},
+	}
+	for id, p := range products {
+		if _, err := index.Put(c, id, p); err != nil {
+			t.Fatalf("Put %s: %v", id, err)
+		}
+	}
+
+	var p Product
+	if err := index.Get(c, "mug", &p); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !reflect.DeepEqual(&p, products["mug"]) {
+		t.Errorf("got product %+v; want %+v", p, products["mug"])
+	}
+
+	var found []string
+	for it := index.Search(c, "gopher", &search.SearchOptions{IDsOnly: true}); ; {
+		id, err := it.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		found = append(found, id)
+	}
+	if len(found) != 2 {
+		t.Errorf("search for gopher found %q; want gopher and mug", found)
+	}
+
+	if err := index.Delete(c, "shirt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	ids, err := c.SearchDocumentIDs("products")
+	if err != nil {
+		t.Fatalf("SearchDocumentIDs: %v", err)
+	}
+	if want := []string{"gopher", "mug"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got documents %q; want %q", ids, want)
+	}
+
+	if err := c.ClearSearchIndex("products"); err != nil {
+		t.Fatalf("ClearSearchIndex: %v", err)
+	}
+	if ids, err := c.SearchDocumentIDs("products"); err != nil || len(ids) != 0 {
+		t.Errorf("got documents %q, %v after ClearSearchIndex; want none", ids, err)
+	}
+}
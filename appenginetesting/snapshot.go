@@ -0,0 +1,337 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine_internal"
+	memcachepb "appengine_internal/memcache"
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// Snapshot is the state of the datastore, memcache and task queues of
+// a Context, saved by Context.Snapshot.
+type Snapshot struct {
+	entities []namespaceEntities
+	memcache map[string][]*memcache.Item // by namespace
+	tasks    map[string][]*trackedTask   // by queue
+}
+
+// Snapshot saves the state of the datastore, memcache and task queues,
+// so that an expensive setup can be done once and restored before every
+// test with Restore.
+//
+// Neither the dev_appserver.py nor the API can list the keys of memcache
+// or the tasks of a queue, so the snapshot only holds the memcache items
+// and tasks set or added through c, or through the Contexts sharing its
+// child, that are still there. The expiration of memcache items and the
+// blobstore and search services are not saved. The writes delayed by
+// Options.Consistency are applied first, as by ApplyWrites.
+func (c *Context) Snapshot() (*Snapshot, error) {
+	entities, err := c.allEntities()
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{
+		entities: entities,
+		memcache: make(map[string][]*memcache.Item),
+		tasks:    c.tracked.queuedTasks(),
+	}
+	for ns, keys := range c.tracked.memcacheKeys() {
+		nc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			return nil, err
+		}
+		items, err := memcache.GetMulti(nc, keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if item, ok := items[key]; ok {
+				s.memcache[ns] = append(s.memcache[ns], item)
+			}
+		}
+	}
+	return s, nil
+}
+
+// putBatchSize is the maximum number of entities of a datastore.PutMulti
+// or DeleteMulti call.
+const putBatchSize = 500
+
+// Restore rolls the datastore, memcache and task queues back to the state
+// saved in s. Entities and tasks created since the snapshot are deleted
+// and memcache is flushed before the saved items are set again.
+//
+// The task queue may keep the names of deleted tasks reserved, so a named
+// task whose name is still taken is added back under a new name; adding
+// a task with the old name keeps failing as it did at the snapshot.
+func (c *Context) Restore(s *Snapshot) error {
+	current, err := c.allEntities()
+	if err != nil {
+		return err
+	}
+	for _, ns := range current {
+		keys := make([]*datastore.Key, len(ns.entities))
+		for i, e := range ns.entities {
+			keys[i] = e.key
+		}
+		if err := c.restoreEntities(ns.namespace, keys, nil); err != nil {
+			return err
+		}
+	}
+	for _, ns := range s.entities {
+		keys := make([]*datastore.Key, len(ns.entities))
+		props := make([]datastore.PropertyList, len(ns.entities))
+		for i, e := range ns.entities {
+			keys[i], props[i] = e.key, e.props
+		}
+		if err := c.restoreEntities(ns.namespace, keys, props); err != nil {
+			return err
+		}
+	}
+	if err := c.ApplyWrites(); err != nil {
+		return err
+	}
+
+	if err := memcache.Flush(c); err != nil {
+		return err
+	}
+	for ns, items := range s.memcache {
+		nc, err := appengine.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		restored := make([]*memcache.Item, len(items))
+		for i, item := range items {
+			restored[i] = &memcache.Item{Key: item.Key, Value: item.Value, Flags: item.Flags}
+		}
+		if err := memcache.SetMulti(nc, restored); err != nil {
+			return err
+		}
+	}
+
+	for _, queue := range c.tracked.queueNames() {
+		req := &taskqueuepb.TaskQueuePurgeQueueRequest{QueueName: []byte(queue)}
+		if err := c.Call("taskqueue", "PurgeQueue", req, &taskqueuepb.TaskQueuePurgeQueueResponse{}, nil); err != nil {
+			return err
+		}
+	}
+	for queue, tasks := range s.tasks {
+		var adds []*taskqueuepb.TaskQueueAddRequest
+		for _, t := range tasks {
+			add := *t.req
+			if !t.named {
+				// Let the task queue choose a new name, as the old
+				// one may not be reused once the task is deleted.
+				add.TaskName = nil
+			}
+			adds = append(adds, &add)
+		}
+		// A taken name sends its task back renamed, and the others of
+		// its batch skipped, so three rounds add every task.
+		for round := 0; len(adds) > 0; round++ {
+			if round == 3 {
+				return fmt.Errorf("appenginetesting: cannot restore %d tasks of queue %s", len(adds), queue)
+			}
+			if adds, err = c.addTasks(queue, adds); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addTasks adds tasks to queue and returns those to add again: the ones
+// whose name is taken, by a task or by a deleted task whose name is still
+// reserved, without their name, and the ones skipped because of them.
+func (c *Context) addTasks(queue string, adds []*taskqueuepb.TaskQueueAddRequest) ([]*taskqueuepb.TaskQueueAddRequest, error) {
+	req := &taskqueuepb.TaskQueueBulkAddRequest{AddRequest: adds}
+	res := &taskqueuepb.TaskQueueBulkAddResponse{}
+	if err := c.Call("taskqueue", "BulkAdd", req, res, nil); err != nil {
+		return nil, err
+	}
+	var retry []*taskqueuepb.TaskQueueAddRequest
+	for i, r := range res.Taskresult {
+		switch code := r.GetResult(); code {
+		case taskqueuepb.TaskQueueServiceError_OK:
+		case taskqueuepb.TaskQueueServiceError_TASK_ALREADY_EXISTS, taskqueuepb.TaskQueueServiceError_TOMBSTONED_TASK:
+			adds[i].TaskName = nil
+			retry = append(retry, adds[i])
+		case taskqueuepb.TaskQueueServiceError_SKIPPED:
+			retry = append(retry, adds[i])
+		default:
+			return nil, &appengine_internal.APIError{
+				Service: "taskqueue",
+				Detail:  "restoring a task of queue " + queue,
+				Code:    int32(code),
+			}
+		}
+	}
+	return retry, nil
+}
+
+// restoreEntities puts the entities of namespace ns with the given keys
+// and properties by batches, or deletes them if props is nil.
+func (c *Context) restoreEntities(ns string, keys []*datastore.Key, props []datastore.PropertyList) error {
+	nc, err := appengine.Namespace(c, ns)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > putBatchSize {
+			n = putBatchSize
+		}
+		if props == nil {
+			err = datastore.DeleteMulti(nc, keys[:n])
+		} else {
+			_, err = datastore.PutMulti(nc, keys[:n], props[:n])
+			props = props[n:]
+		}
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// tracker records the memcache keys set and the tasks added through the
+// Contexts sharing a child, which the API cannot list.
+type tracker struct {
+	mu    sync.Mutex
+	keys  map[string]map[string]bool // memcache keys by namespace
+	tasks map[string][]*trackedTask  // by queue
+}
+
+type trackedTask struct {
+	req   *taskqueuepb.TaskQueueAddRequest // with the name of the task
+	named bool                             // the name was given by the application
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		keys:  make(map[string]map[string]bool),
+		tasks: make(map[string][]*trackedTask),
+	}
+}
+
+// trackCall is the callHook recording the memcache keys and tasks for
+// Snapshot.
+func trackCall(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if err := next(); err != nil {
+		return err
+	}
+	t := c.tracked
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch service + "." + method {
+	case "memcache.Set":
+		req := in.(*memcachepb.MemcacheSetRequest)
+		for _, item := range req.Item {
+			t.addKey(req.GetNameSpace(), item.Key)
+		}
+	case "memcache.Increment":
+		req := in.(*memcachepb.MemcacheIncrementRequest)
+		t.addKey(req.GetNameSpace(), req.Key)
+	case "memcache.BatchIncrement":
+		req := in.(*memcachepb.MemcacheBatchIncrementRequest)
+		for _, item := range req.Item {
+			t.addKey(req.GetNameSpace(), item.Key)
+		}
+	case "memcache.FlushAll":
+		t.keys = make(map[string]map[string]bool)
+	case "taskqueue.Add":
+		t.addTask(in.(*taskqueuepb.TaskQueueAddRequest), out.(*taskqueuepb.TaskQueueAddResponse).ChosenTaskName)
+	case "taskqueue.BulkAdd":
+		res := out.(*taskqueuepb.TaskQueueBulkAddResponse)
+		for i, req := range in.(*taskqueuepb.TaskQueueBulkAddRequest).AddRequest {
+			if i < len(res.Taskresult) && res.Taskresult[i].GetResult() == taskqueuepb.TaskQueueServiceError_OK {
+				t.addTask(req, res.Taskresult[i].ChosenTaskName)
+			}
+		}
+	case "taskqueue.Delete":
+		req := in.(*taskqueuepb.TaskQueueDeleteRequest)
+		for _, name := range req.TaskName {
+			t.deleteTask(string(req.QueueName), string(name))
+		}
+	case "taskqueue.PurgeQueue":
+		delete(t.tasks, string(in.(*taskqueuepb.TaskQueuePurgeQueueRequest).QueueName))
+	}
+	return nil
+}
+
+func (t *tracker) addKey(ns string, key []byte) {
+	if t.keys[ns] == nil {
+		t.keys[ns] = make(map[string]bool)
+	}
+	t.keys[ns][string(key)] = true
+}
+
+// addTask records the task added by req, named chosen if the task queue
+// chose its name.
+func (t *tracker) addTask(req *taskqueuepb.TaskQueueAddRequest, chosen []byte) {
+	task := &trackedTask{req: req, named: len(req.TaskName) > 0}
+	if !task.named {
+		r := *req
+		r.TaskName = chosen
+		task.req = &r
+	}
+	queue := string(req.QueueName)
+	t.tasks[queue] = append(t.tasks[queue], task)
+}
+
+func (t *tracker) deleteTask(queue, name string) {
+	tasks := t.tasks[queue][:0]
+	for _, task := range t.tasks[queue] {
+		if string(task.req.TaskName) != name {
+			tasks = append(tasks, task)
+		}
+	}
+	t.tasks[queue] = tasks
+}
+
+// memcacheKeys returns the tracked memcache keys by namespace.
+func (t *tracker) memcacheKeys() map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string][]string)
+	for ns, keys := range t.keys {
+		for key := range keys {
+			m[ns] = append(m[ns], key)
+		}
+		sort.Strings(m[ns])
+	}
+	return m
+}
+
+// queuedTasks returns a copy of the tracked tasks by queue.
+func (t *tracker) queuedTasks() map[string][]*trackedTask {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string][]*trackedTask)
+	for queue, tasks := range t.tasks {
+		if len(tasks) > 0 {
+			m[queue] = append([]*trackedTask(nil), tasks...)
+		}
+	}
+	return m
+}
+
+// queueNames returns the names of the queues tracked tasks were added to.
+func (t *tracker) queueNames() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for queue := range t.tasks {
+		names = append(names, queue)
+	}
+	sort.Strings(names)
+	return names
+}
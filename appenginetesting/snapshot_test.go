@@ -0,0 +1,80 @@
+package appenginetesting
+
+import (
+	"testing"
+
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/taskqueue"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c, err := NewContext(&Options{TaskQueues: []string{"testQueue"}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	seeded := datastore.NewKey(c, "Entity", "seeded", 0, nil)
+	if _, err := datastore.Put(c, seeded, &Entity{Foo: "seeded"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := memcache.Set(c, &memcache.Item{Key: "k", Value: []byte("seeded")}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	if _, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/seeded", nil), "testQueue"); err != nil {
+		t.Fatalf("taskqueue.Add: %v", err)
+	}
+	named := taskqueue.NewPOSTTask("/named", nil)
+	named.Name = "seeded-named"
+	if _, err := taskqueue.Add(c, named, "testQueue"); err != nil {
+		t.Fatalf("taskqueue.Add named: %v", err)
+	}
+
+	snap, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Entity", "added", 0, nil), &Entity{Foo: "added"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := datastore.Delete(c, seeded); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := memcache.Set(c, &memcache.Item{Key: "k", Value: []byte("changed")}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	if _, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/added", nil), "testQueue"); err != nil {
+		t.Fatalf("taskqueue.Add: %v", err)
+	}
+
+	if err := c.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	var keys []*datastore.Key
+	if keys, err = datastore.NewQuery("Entity").KeysOnly().GetAll(c, nil); err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(seeded) {
+		t.Errorf("got keys %v after Restore; want [%v]", keys, seeded)
+	}
+	item, err := memcache.Get(c, "k")
+	if err != nil {
+		t.Fatalf("memcache.Get: %v", err)
+	}
+	if string(item.Value) != "seeded" {
+		t.Errorf("got memcache value %q after Restore; want %q", item.Value, "seeded")
+	}
+	stats, err := taskqueue.QueueStats(c, []string{"testQueue"}, 0)
+	if err != nil {
+		t.Fatalf("QueueStats: %v", err)
+	}
+	if stats[0].Tasks != 2 {
+		t.Errorf("got %d tasks after Restore; want 2", stats[0].Tasks)
+	}
+	if _, err := taskqueue.Add(c, named, "testQueue"); err != taskqueue.ErrTaskAlreadyAdded {
+		t.Errorf("adding the named task again after Restore: got %v; want ErrTaskAlreadyAdded", err)
+	}
+}
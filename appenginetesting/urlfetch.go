@@ -0,0 +1,273 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine_internal"
+	urlfetchpb "appengine_internal/urlfetch"
+)
+
+// FetchStub answers the urlfetch calls of the application in place of
+// the network. Until an expectation or a transport is set, the calls go
+// to the child dev_appserver.py, which makes real requests. Once one is
+// set, fetching a URL matching no expectation fails.
+type FetchStub struct {
+	mu           sync.Mutex
+	expectations []*FetchExpectation
+	transport    http.RoundTripper
+	requests     []*http.Request
+}
+
+// FetchExpectation is a URL the application is expected to fetch, and
+// the way to answer it.
+type FetchExpectation struct {
+	s      *FetchStub // whose mu guards the fields below
+	method string
+	url    *regexp.Regexp
+	times  int // 0 for any number of times
+	calls  int
+
+	handler   http.Handler
+	transport http.RoundTripper
+}
+
+// URLFetch returns the urlfetch stub of c.
+func (c *Context) URLFetch() *FetchStub {
+	return c.urlfetch
+}
+
+// Expect adds an expectation of fetches with the given method, or any
+// method if empty, of URLs matching the regular expression url. The
+// expectations are matched in order. By default, the fetches are answered
+// with an empty 200 response.
+func (s *FetchStub) Expect(method, url string) (*FetchExpectation, error) {
+	re, err := regexp.Compile("^(" + url + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("appenginetesting: invalid URL pattern %q: %v", url, err)
+	}
+	e := &FetchExpectation{
+		s:      s,
+		method: method,
+		url:    re,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expectations = append(s.expectations, e)
+	return e, nil
+}
+
+// Transport sets the transport answering the fetches that match no
+// expectation, instead of failing them.
+func (s *FetchStub) Transport(rt http.RoundTripper) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transport = rt
+}
+
+// Requests returns the requests fetched so far, in order.
+func (s *FetchStub) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// Unmet returns a description of the expectations given a number of
+// times that were fetched fewer times.
+func (s *FetchStub) Unmet() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unmet []string
+	for _, e := range s.expectations {
+		if e.calls < e.times {
+			unmet = append(unmet, fmt.Sprintf("%s fetched %d times; want %d", e, e.calls, e.times))
+		}
+	}
+	return unmet
+}
+
+func (e *FetchExpectation) String() string {
+	method := e.method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + e.url.String()
+}
+
+// Times makes e match only the first n fetches, and be unmet until then.
+func (e *FetchExpectation) Times(n int) *FetchExpectation {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	e.times = n
+	return e
+}
+
+// Respond answers the fetches with the given status and body.
+func (e *FetchExpectation) Respond(status int, body string) *FetchExpectation {
+	return e.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+// Handler answers the fetches with h.
+func (e *FetchExpectation) Handler(h http.Handler) *FetchExpectation {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	e.handler, e.transport = h, nil
+	return e
+}
+
+// Transport answers the fetches with rt.
+func (e *FetchExpectation) Transport(rt http.RoundTripper) *FetchExpectation {
+	e.s.mu.Lock()
+	defer e.s.mu.Unlock()
+	e.handler, e.transport = nil, rt
+	return e
+}
+
+// Server answers the fetches by sending them to ts, whatever their host.
+// ts may be started with httptest.NewTLSServer.
+func (e *FetchExpectation) Server(ts *httptest.Server) *FetchExpectation {
+	return e.Transport(serverTransport{ts})
+}
+
+// serverTransport sends requests to a test server.
+type serverTransport struct {
+	ts *httptest.Server
+}
+
+// testServerTransport is the transport of serverTransport. The App Engine
+// runtime replaces http.DefaultTransport with one failing every request.
+// The certificates of the test servers are self-signed.
+var testServerTransport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+func (t serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.ts.URL)
+	if err != nil {
+		return nil, err
+	}
+	r := *req
+	r.URL = new(url.URL)
+	*r.URL = *req.URL
+	r.URL.Scheme, r.URL.Host = u.Scheme, u.Host
+	return testServerTransport.RoundTrip(&r)
+}
+
+// match returns a copy of the expectation matching req and counts the
+// call, or nil.
+func (s *FetchStub) match(req *http.Request) *FetchExpectation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	for _, e := range s.expectations {
+		if e.method != "" && e.method != req.Method {
+			continue
+		}
+		if e.times > 0 && e.calls >= e.times {
+			continue
+		}
+		if e.url.MatchString(req.URL.String()) {
+			e.calls++
+			m := *e
+			return &m
+		}
+	}
+	return nil
+}
+
+func (s *FetchStub) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.expectations) > 0 || s.transport != nil
+}
+
+// stubURLFetch is the callHook answering urlfetch calls with the
+// FetchStub of the Context, once configured.
+func stubURLFetch(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	s := c.urlfetch
+	if service != "urlfetch" || method != "Fetch" || !s.active() {
+		return next()
+	}
+	req, err := fetchRequest(in.(*urlfetchpb.URLFetchRequest))
+	if err != nil {
+		return fetchError(urlfetchpb.URLFetchServiceError_INVALID_URL, err.Error())
+	}
+
+	var res *http.Response
+	e := s.match(req)
+	switch {
+	case e != nil && e.transport != nil:
+		res, err = e.transport.RoundTrip(req)
+	case e != nil && e.handler != nil:
+		res = serve(e.handler, req)
+	case e != nil:
+		res = serve(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), req)
+	case s.transport != nil:
+		res, err = s.transport.RoundTrip(req)
+	default:
+		return fetchError(urlfetchpb.URLFetchServiceError_FETCH_ERROR, "unexpected fetch of "+req.Method+" "+req.URL.String())
+	}
+	if err != nil {
+		return fetchError(urlfetchpb.URLFetchServiceError_FETCH_ERROR, err.Error())
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fetchError(urlfetchpb.URLFetchServiceError_FETCH_ERROR, err.Error())
+	}
+
+	r := out.(*urlfetchpb.URLFetchResponse)
+	r.Content = body
+	r.StatusCode = proto.Int32(int32(res.StatusCode))
+	r.FinalUrl = proto.String(req.URL.String())
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			r.Header = append(r.Header, &urlfetchpb.URLFetchResponse_Header{
+				Key:   proto.String(k),
+				Value: proto.String(v),
+			})
+		}
+	}
+	return nil
+}
+
+// fetchRequest returns the HTTP request of a Fetch call.
+func fetchRequest(in *urlfetchpb.URLFetchRequest) (*http.Request, error) {
+	req, err := http.NewRequest(in.GetMethod().String(), in.GetUrl(), bytes.NewReader(in.Payload))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range in.Header {
+		req.Header.Add(h.GetKey(), h.GetValue())
+	}
+	return req, nil
+}
+
+// serve returns the response of h to req.
+func serve(h http.Handler, req *http.Request) *http.Response {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return &http.Response{
+		StatusCode: w.Code,
+		Header:     w.Header(),
+		Body:       ioutil.NopCloser(w.Body),
+	}
+}
+
+func fetchError(code urlfetchpb.URLFetchServiceError_ErrorCode, detail string) error {
+	return &appengine_internal.APIError{
+		Service: "urlfetch",
+		Detail:  detail,
+		Code:    int32(code),
+	}
+}
@@ -0,0 +1,84 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"appengine/urlfetch"
+)
+
+func TestURLFetchStub(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "token for %s", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	charge, err := c.URLFetch().Expect("POST", "https://payments.example.com/charge")
+	if err != nil {
+		t.Fatalf("Expect: %v", err)
+	}
+	charge.Respond(http.StatusPaymentRequired, "declined").Times(1)
+	token, err := c.URLFetch().Expect("GET", "https://oauth.example.com/.*")
+	if err != nil {
+		t.Fatalf("Expect: %v", err)
+	}
+	token.Server(ts)
+	if _, err := c.URLFetch().Expect("GET", "https://(broken"); err == nil {
+		t.Errorf("Expect with an invalid pattern succeeded")
+	}
+
+	client := urlfetch.Client(c)
+	get := func(method, url string) (int, string) {
+		req, _ := http.NewRequest(method, url, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := get("POST", "https://payments.example.com/charge"); code != http.StatusPaymentRequired || body != "declined" {
+		t.Errorf("got charge response %d %q", code, body)
+	}
+	if code, body := get("GET", "https://oauth.example.com/token"); code != http.StatusOK || body != "token for /token" {
+		t.Errorf("got token response %d %q", code, body)
+	}
+	if unmet := c.URLFetch().Unmet(); len(unmet) != 0 {
+		t.Errorf("unmet expectations: %q", unmet)
+	}
+
+	// The charge was expected once.
+	if _, err := client.Post("https://payments.example.com/charge", "text/plain", nil); err == nil {
+		t.Errorf("unexpected fetch succeeded")
+	}
+	if n := len(c.URLFetch().Requests()); n != 3 {
+		t.Errorf("got %d requests; want 3", n)
+	}
+}
+
+func TestServerTransportTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", "https://oauth.example.com/token", nil)
+	res, err := serverTransport{ts}.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "/token" {
+		t.Errorf("got body %q; want /token", body)
+	}
+}
@@ -0,0 +1,181 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"encoding/xml"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"appengine/xmpp"
+	"appengine_internal"
+	xmpppb "appengine_internal/xmpp"
+)
+
+// XMPP holds the XMPP messages, presences and invitations sent through
+// the Contexts sharing a child, and the presence of the JIDs returned by
+// xmpp.GetPresence. The calls are answered in process.
+type XMPP struct {
+	mu        sync.Mutex
+	messages  []*xmpp.Message
+	presences []*SentPresence
+	invites   []*Invite
+	show      map[string]string // by JID, for the available ones
+}
+
+// SentPresence is a presence sent by the application.
+type SentPresence struct {
+	Sender, To string
+	Type       string // such as "probe"; "" means available
+	Show       string // such as "away"
+	Status     string
+}
+
+// Invite is a chat invitation sent with xmpp.Invite.
+type Invite struct {
+	Sender, To string
+}
+
+func newXMPP() *XMPP {
+	return &XMPP{show: make(map[string]string)}
+}
+
+// XMPP returns the XMPP messages, presences and invitations of c.
+func (c *Context) XMPP() *XMPP {
+	return c.xmpp
+}
+
+// Messages returns the messages sent so far, in order.
+func (x *XMPP) Messages() []*xmpp.Message {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]*xmpp.Message(nil), x.messages...)
+}
+
+// Presences returns the presences sent so far, in order.
+func (x *XMPP) Presences() []*SentPresence {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]*SentPresence(nil), x.presences...)
+}
+
+// Invites returns the invitations sent so far, in order.
+func (x *XMPP) Invites() []*Invite {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]*Invite(nil), x.invites...)
+}
+
+// SetPresence makes xmpp.GetPresence report jid as available, with show
+// one of "", "away", "dnd", "chat" or "xa". Other JIDs are unavailable.
+func (x *XMPP) SetPresence(jid, show string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.show[jid] = show
+}
+
+// Clear forgets the messages, presences and invitations sent.
+func (x *XMPP) Clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.messages, x.presences, x.invites = nil, nil, nil
+}
+
+var presenceShows = map[string]xmpppb.PresenceResponse_SHOW{
+	"":     xmpppb.PresenceResponse_NORMAL,
+	"away": xmpppb.PresenceResponse_AWAY,
+	"dnd":  xmpppb.PresenceResponse_DO_NOT_DISTURB,
+	"chat": xmpppb.PresenceResponse_CHAT,
+	"xa":   xmpppb.PresenceResponse_EXTENDED_AWAY,
+}
+
+// fakeXMPP is the callHook answering the xmpp calls.
+func fakeXMPP(c *Context, service, method string, in, out appengine_internal.ProtoMessage, next func() error) error {
+	if service != "xmpp" {
+		return next()
+	}
+	x := c.xmpp
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	switch method {
+	case "SendMessage":
+		req := in.(*xmpppb.XmppMessageRequest)
+		x.messages = append(x.messages, &xmpp.Message{
+			Sender: req.GetFromJid(),
+			To:     req.Jid,
+			Body:   req.GetBody(),
+			RawXML: req.GetRawXml(),
+			Type:   req.GetType(),
+		})
+		res := out.(*xmpppb.XmppMessageResponse)
+		for range req.Jid {
+			res.Status = append(res.Status, xmpppb.XmppMessageResponse_NO_ERROR)
+		}
+		return nil
+	case "SendPresence":
+		req := in.(*xmpppb.XmppSendPresenceRequest)
+		x.presences = append(x.presences, &SentPresence{
+			Sender: req.GetFromJid(),
+			To:     req.GetJid(),
+			Type:   req.GetType(),
+			Show:   req.GetShow(),
+			Status: req.GetStatus(),
+		})
+		return nil
+	case "SendInvite":
+		req := in.(*xmpppb.XmppInviteRequest)
+		x.invites = append(x.invites, &Invite{Sender: req.GetFromJid(), To: req.GetJid()})
+		return nil
+	case "GetPresence":
+		res := out.(*xmpppb.PresenceResponse)
+		show, ok := x.show[in.(*xmpppb.PresenceRequest).GetJid()]
+		res.IsAvailable = proto.Bool(ok)
+		res.Valid = proto.Bool(true)
+		if ok {
+			p := presenceShows[show]
+			res.Presence = &p
+		}
+		return nil
+	}
+	return next()
+}
+
+// DeliverXMPP POSTs m to h the way App Engine delivers inbound chat
+// messages: to /_ah/xmpp/message/chat/, once for each recipient, with the
+// from, to, body and stanza form fields.
+func (c *Context) DeliverXMPP(h http.Handler, m *xmpp.Message) []*httptest.ResponseRecorder {
+	var responses []*httptest.ResponseRecorder
+	for _, to := range m.To {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("from", m.Sender)
+		w.WriteField("to", to)
+		w.WriteField("body", m.Body)
+		w.WriteField("stanza", chatStanza(m.Sender, to, m.Body))
+		w.Close()
+
+		req, _ := http.NewRequest("POST", "/_ah/xmpp/message/chat/", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		responses = append(responses, rec)
+	}
+	return responses
+}
+
+// chatStanza returns the XML stanza of a chat message.
+func chatStanza(from, to, body string) string {
+	var buf bytes.Buffer
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	buf.WriteString(`<message from="` + esc(from) + `" to="` + esc(to) + `" type="chat">`)
+	buf.WriteString("<body>" + esc(body) + "</body></message>")
+	return buf.String()
+}
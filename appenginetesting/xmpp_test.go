@@ -0,0 +1,71 @@
+package appenginetesting
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"appengine"
+	"appengine/xmpp"
+)
+
+// The handler of xmpp.Handle is registered on http.DefaultServeMux, once
+// per test binary; it passes the messages it parses to xmppDelivered.
+var (
+	xmppHandle    sync.Once
+	xmppDelivered = make(chan *xmpp.Message, 1)
+)
+
+func TestXMPP(t *testing.T) {
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	m := &xmpp.Message{Sender: "bot@testapp.appspotchat.com", To: []string{"alice@example.com"}, Body: "hello"}
+	if err := m.Send(c); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := c.XMPP().Messages(); len(got) != 1 || got[0].Body != "hello" || !reflect.DeepEqual(got[0].To, m.To) {
+		t.Errorf("got messages %+v; want %+v", got, m)
+	}
+	if err := xmpp.Invite(c, "bob@example.com", ""); err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if got := c.XMPP().Invites(); len(got) != 1 || got[0].To != "bob@example.com" {
+		t.Errorf("got invites %+v; want one to bob@example.com", got)
+	}
+
+	c.XMPP().SetPresence("alice@example.com", "away")
+	if show, err := xmpp.GetPresence(c, "alice@example.com", ""); err != nil || show != "away" {
+		t.Errorf("GetPresence(alice) = %q, %v; want away", show, err)
+	}
+	if _, err := xmpp.GetPresence(c, "bob@example.com", ""); err == nil {
+		t.Errorf("GetPresence(bob) succeeded; want an error")
+	}
+
+	c.XMPP().Clear()
+	if got := c.XMPP().Messages(); len(got) != 0 {
+		t.Errorf("got messages %+v after Clear; want none", got)
+	}
+
+	xmppHandle.Do(func() {
+		xmpp.Handle(func(_ appengine.Context, m *xmpp.Message) { xmppDelivered <- m })
+	})
+	want := &xmpp.Message{Sender: "alice@example.com", To: []string{"bot@testapp.appspotchat.com"}, Body: "ping & pong"}
+	c.DeliverXMPP(http.DefaultServeMux, want)
+	select {
+	case got := <-xmppDelivered:
+		if got.Sender != want.Sender || !reflect.DeepEqual(got.To, want.To) || got.Body != want.Body {
+			t.Errorf("got delivered message %+v; want %+v", got, want)
+		}
+	default:
+		t.Errorf("no message delivered to the xmpp.Handle handler")
+	}
+	if stanza := chatStanza("alice@example.com", "bot@testapp.appspotchat.com", "ping & pong"); !strings.Contains(stanza, "<body>ping &amp; pong</body>") {
+		t.Errorf("got stanza %q", stanza)
+	}
+}
@@ -3,76 +3,163 @@ package appenginetestinit
 import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 var (
 	SavedHttpTransport = http.DefaultTransport
 	SavedHttpClient    = http.DefaultClient
+
+	// SavedStdin is the standard input of the process before Bootstrap
+	// pointed os.Stdin at the instance configuration.
+	SavedStdin = os.Stdin
 )
 
-// Call this function from your test package init() function
+var (
+	bootstrapMu  sync.Mutex
+	bootstrapped bool
+)
+
+// Use sets up the App Engine runtime of the test binary with the
+// settings returned by LoadSettings. It panics if the setup failed.
+// The init function of this package already does so in test binaries;
+// importing the package and calling Use keeps that import in use.
+//
+// Call this function from your test package init() function.
 func Use() {
-	// nothing here
+	if err := Bootstrap(nil); err != nil {
+		panic(err)
+	}
 }
 
-func init() {
-	if strings.LastIndex(os.Args[0], "test") != len(os.Args[0])-len("test") {
-		// not a test environment
-		SavedHttpTransport = nil
-		SavedHttpClient = nil
-		return
+// Bootstrap hands the instance configuration described by s to the App
+// Engine runtime. A nil s means the settings returned by LoadSettings.
+//
+// The runtime may read its configuration as soon as it is initialized,
+// so test binaries are bootstrapped by the init function of this
+// package, with the settings of the environment variables and the file
+// described by Settings. Call Bootstrap in other programs, such as test
+// drivers not built by go test, before the runtime is initialized.
+//
+// The configuration is passed through an in-memory pipe. The runtime
+// reads it from os.Stdin, so that variable is pointed at the pipe; the
+// file descriptor of the process standard input is left untouched and
+// the original os.Stdin is kept in SavedStdin.
+//
+// The runtime reads its configuration once: after a successful call,
+// Bootstrap(nil) does nothing and other settings are an error.
+func Bootstrap(s *Settings) error {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+	if bootstrapped {
+		if s != nil {
+			return errors.New("appenginetestinit: the runtime is already bootstrapped")
+		}
+		return nil
 	}
+	if err := bootstrap(s); err != nil {
+		return err
+	}
+	bootstrapped = true
+	return nil
+}
 
-	// Task: push AppEngine Go Instance config to stdin
-
-	// 1. create configuration instance
-	port := int32(8080)
-	dc := "/"
-	id := "test-instance"
-	authDomain := "test"
-	config := Config{
-		AppId:           []byte("test-app"),
-		VersionId:       []byte("test"),
-		ApplicationRoot: []byte("."),
-		ApiPort:         &port,
-		Datacenter:      &dc,
-		InstanceId:      &id,
-		AuthDomain:      &authDomain,
+func bootstrap(s *Settings) error {
+	var err error
+	if s == nil {
+		if s, err = LoadSettings(); err != nil {
+			return err
+		}
 	}
 
-	// 2. serialize configuration
-	bytes, err := proto.Marshal(&config)
+	bytes, err := proto.Marshal(s.config())
 	if err != nil {
-		panic(err)
+		return err
 	}
 	output := base64.StdEncoding.EncodeToString(bytes)
 
-	// 3. write configuration to a file
-	dir := os.TempDir()
-	fo, err := os.Create(dir + "/appcfg.proto")
+	r, w, err := os.Pipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	// Write from a goroutine so that a configuration larger than the
+	// pipe buffer does not block until the runtime reads it.
+	go func() {
+		w.Write([]byte(output))
+		w.Close()
+	}()
+	os.Stdin = r
+	return nil
+}
 
-	n := len(output)
-	for n > 0 {
-		cnt, err := fo.Write([]byte(output[len(output)-n : len(output)]))
-		if err != nil {
-			panic(err)
+// isTestBinary reports whether the process is a test binary, whatever
+// its name.
+func isTestBinary() bool {
+	return flag.Lookup("test.v") != nil || isTestArgs(os.Args)
+}
+
+// isTestArgs reports whether args are the command line of a test binary.
+func isTestArgs(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-test.") {
+			return true
 		}
-		n -= cnt
 	}
+	return strings.HasSuffix(args[0], "test") || strings.HasSuffix(args[0], ".test.exe")
+}
 
-	if err = fo.Close(); err != nil {
+func init() {
+	if !isTestBinary() {
+		// not a test environment
+		SavedHttpTransport = nil
+		SavedHttpClient = nil
+		return
+	}
+	if err := Bootstrap(nil); err != nil {
 		panic(err)
 	}
+}
 
-	// 4. Point standard input to the configuration file
-	os.Stdin, err = os.Open(dir + "/appcfg.proto")
-	if err != nil {
-		panic(err)
+// Setenv sets the variables of env in the process environment, as the
+// runtime does for the Environ entries of its configuration when it
+// starts. The returned function restores the previous values.
+//
+// The configuration read by the runtime is not changed; use
+// Settings.Environ for that. The process environment is shared by the
+// whole test binary, so concurrent callers must not set the same
+// variables to different values.
+func Setenv(env map[string]string) (restore func(), err error) {
+	prev := make(map[string]*string)
+	for k := range env {
+		prev[k] = nil
+		if v, ok := syscall.Getenv(k); ok {
+			prev[k] = &v
+		}
+	}
+	restore = func() {
+		for k, v := range prev {
+			if v != nil {
+				os.Setenv(k, *v)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			restore()
+			return nil, err
+		}
 	}
+	return restore, nil
 }
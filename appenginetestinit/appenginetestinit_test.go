@@ -0,0 +1,88 @@
+package appenginetestinit
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// TestBootstrap checks the configuration handed to the runtime by the
+// init function of the package.
+func TestBootstrap(t *testing.T) {
+	defer func() { os.Stdin = SavedStdin }()
+
+	if os.Stdin == SavedStdin {
+		t.Fatalf("os.Stdin was not pointed at the configuration")
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		t.Fatalf("reading the configuration: %v", err)
+	}
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		t.Fatalf("decoding the configuration: %v", err)
+	}
+	var config Config
+	if err := proto.Unmarshal(b, &config); err != nil {
+		t.Fatalf("unmarshaling the configuration: %v", err)
+	}
+	s, err := LoadSettings()
+	if err != nil {
+		t.Fatalf("LoadSettings: %v", err)
+	}
+	if want := s.config(); !reflect.DeepEqual(&config, want) {
+		t.Errorf("got configuration %v; want %v", &config, want)
+	}
+
+	if err := Bootstrap(nil); err != nil {
+		t.Errorf("Bootstrap(nil) after bootstrapping: %v", err)
+	}
+	if err := Bootstrap(DefaultSettings()); err == nil {
+		t.Errorf("Bootstrap with other settings succeeded after bootstrapping; want an error")
+	}
+}
+
+// TestBootstrapEnv runs TestBootstrap in a test binary started with
+// settings in its environment.
+func TestBootstrapEnv(t *testing.T) {
+	if os.Getenv("APPENGINE_TEST_VERSION_ID") != "" {
+		t.Skip("already running with settings in the environment")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBootstrap$", "-test.v")
+	cmd.Env = append(os.Environ(), "APPENGINE_TEST_VERSION_ID=2-beta", "APPENGINE_TEST_ENV_STAGE=staging")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("TestBootstrap with settings in the environment: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "--- PASS: TestBootstrap") {
+		t.Errorf("TestBootstrap did not run:\n%s", out)
+	}
+}
+
+func TestIsTestBinary(t *testing.T) {
+	if !isTestBinary() {
+		t.Errorf("isTestBinary() = false in a test binary")
+	}
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"/tmp/go-build1/pkg.test"}, true},
+		{[]string{`C:\tmp\pkg.test.exe`}, true},
+		{[]string{"/tmp/integration", "-test.v", "-test.run=Foo"}, true},
+		{[]string{"/usr/bin/server"}, false},
+		{[]string{"/usr/bin/server", "-port=8080"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isTestArgs(tt.args); got != tt.want {
+			t.Errorf("isTestArgs(%q) = %v; want %v", tt.args, got, tt.want)
+		}
+	}
+}
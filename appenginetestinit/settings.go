@@ -0,0 +1,169 @@
+package appenginetestinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Settings describe the instance configuration handed to the App Engine
+// runtime of the test binary. They determine, among others, the values
+// of appengine.VersionID and appengine.Datacenter. appengine.AppID of an
+// appenginetesting.Context is the AppId of its Options instead.
+//
+// The settings are read from the JSON file named by $APPENGINE_TEST_CONFIG,
+// if set, and then overridden by these environment variables:
+//
+//	APPENGINE_TEST_APP_ID       AppId
+//	APPENGINE_TEST_VERSION_ID   VersionId
+//	APPENGINE_TEST_API_PORT     ApiPort
+//	APPENGINE_TEST_DATACENTER   Datacenter
+//	APPENGINE_TEST_INSTANCE_ID  InstanceId
+//	APPENGINE_TEST_AUTH_DOMAIN  AuthDomain
+//	APPENGINE_TEST_THREADSAFE   Threadsafe ("true" or "false")
+//	APPENGINE_TEST_LIBRARIES    Libraries ("name:version,name:version")
+//	APPENGINE_TEST_ENV_<KEY>    Environ entry KEY
+type Settings struct {
+	AppId      string            `json:"app_id"`
+	VersionId  string            `json:"version_id"`
+	ApiPort    int32             `json:"api_port"`
+	Datacenter string            `json:"datacenter"`
+	InstanceId string            `json:"instance_id"`
+	AuthDomain string            `json:"auth_domain"`
+	Threadsafe bool              `json:"threadsafe"`
+	Libraries  map[string]string `json:"libraries"` // name to version
+	Environ    map[string]string `json:"environ"`
+}
+
+const envPrefix = "APPENGINE_TEST_"
+
+// DefaultSettings returns the settings used when nothing is configured.
+func DefaultSettings() *Settings {
+	return &Settings{
+		AppId:      "test-app",
+		VersionId:  "test",
+		ApiPort:    8080,
+		Datacenter: "/",
+		InstanceId: "test-instance",
+		AuthDomain: "test",
+	}
+}
+
+// LoadSettings returns the default settings updated from the config file
+// and the environment variables.
+func LoadSettings() (*Settings, error) {
+	s := DefaultSettings()
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("appenginetestinit: parsing %s: %v", path, err)
+		}
+	}
+	if err := s.readEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Settings) readEnv(environ []string) error {
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := kv[len(envPrefix):i], kv[i+1:]
+
+		var err error
+		switch key {
+		case "CONFIG":
+		case "APP_ID":
+			s.AppId = value
+		case "VERSION_ID":
+			s.VersionId = value
+		case "API_PORT":
+			var port int64
+			port, err = strconv.ParseInt(value, 10, 32)
+			s.ApiPort = int32(port)
+		case "DATACENTER":
+			s.Datacenter = value
+		case "INSTANCE_ID":
+			s.InstanceId = value
+		case "AUTH_DOMAIN":
+			s.AuthDomain = value
+		case "THREADSAFE":
+			s.Threadsafe, err = strconv.ParseBool(value)
+		case "LIBRARIES":
+			s.Libraries = make(map[string]string)
+			if strings.TrimSpace(value) == "" {
+				break
+			}
+			for _, lib := range strings.Split(value, ",") {
+				nv := strings.SplitN(strings.TrimSpace(lib), ":", 2)
+				if len(nv) != 2 {
+					return fmt.Errorf("appenginetestinit: invalid library %q in %s; want name:version", lib, envPrefix+key)
+				}
+				s.Libraries[nv[0]] = nv[1]
+			}
+		default:
+			if !strings.HasPrefix(key, "ENV_") {
+				continue
+			}
+			if s.Environ == nil {
+				s.Environ = make(map[string]string)
+			}
+			s.Environ[key[len("ENV_"):]] = value
+		}
+		if err != nil {
+			return fmt.Errorf("appenginetestinit: invalid %s: %v", envPrefix+key, err)
+		}
+	}
+	return nil
+}
+
+// config returns the Config proto sent to the runtime.
+func (s *Settings) config() *Config {
+	config := &Config{
+		AppId:           []byte(s.AppId),
+		VersionId:       []byte(s.VersionId),
+		ApplicationRoot: []byte("."),
+		Threadsafe:      proto.Bool(s.Threadsafe),
+		ApiPort:         proto.Int32(s.ApiPort),
+		Datacenter:      proto.String(s.Datacenter),
+		InstanceId:      proto.String(s.InstanceId),
+		AuthDomain:      proto.String(s.AuthDomain),
+	}
+	for _, name := range sortedKeys(s.Libraries) {
+		config.Libraries = append(config.Libraries, &Library{
+			Name:    proto.String(name),
+			Version: proto.String(s.Libraries[name]),
+		})
+	}
+	for _, key := range sortedKeys(s.Environ) {
+		config.Environ = append(config.Environ, &Environ{
+			Key:   []byte(key),
+			Value: []byte(s.Environ[key]),
+		})
+	}
+	return config
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package appenginetestinit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnv(t *testing.T) {
+	tests := []struct {
+		environ []string
+		want    func(s *Settings)
+		wantErr bool
+	}{
+		{
+			environ: []string{"APPENGINE_TEST_API_PORT=9000", "HOME=/root"},
+			want:    func(s *Settings) { s.ApiPort = 9000 },
+		},
+		{
+			environ: []string{"APPENGINE_TEST_API_PORT=http"},
+			wantErr: true,
+		},
+		{
+			environ: []string{"APPENGINE_TEST_API_PORT=99999999999"},
+			wantErr: true,
+		},
+		{
+			environ: []string{"APPENGINE_TEST_THREADSAFE=true"},
+			want:    func(s *Settings) { s.Threadsafe = true },
+		},
+		{
+			environ: []string{"APPENGINE_TEST_THREADSAFE=maybe"},
+			wantErr: true,
+		},
+		{
+			environ: []string{"APPENGINE_TEST_LIBRARIES=ssl:2.7, lxml:latest"},
+			want:    func(s *Settings) { s.Libraries = map[string]string{"ssl": "2.7", "lxml": "latest"} },
+		},
+		{
+			environ: []string{"APPENGINE_TEST_LIBRARIES="},
+			want:    func(s *Settings) { s.Libraries = map[string]string{} },
+		},
+		{
+			environ: []string{"APPENGINE_TEST_LIBRARIES=ssl"},
+			wantErr: true,
+		},
+		{
+			environ: []string{"APPENGINE_TEST_ENV_STAGE=staging", "APPENGINE_TEST_ENV_EMPTY="},
+			want:    func(s *Settings) { s.Environ = map[string]string{"STAGE": "staging", "EMPTY": ""} },
+		},
+		{
+			environ: []string{"APPENGINE_TEST_VERSION_ID=2-beta", "APPENGINE_TEST_DATACENTER=us1", "APPENGINE_TEST_UNKNOWN=x"},
+			want:    func(s *Settings) { s.VersionId, s.Datacenter = "2-beta", "us1" },
+		},
+	}
+	for _, tt := range tests {
+		s := DefaultSettings()
+		err := s.readEnv(tt.environ)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readEnv(%q) succeeded; want an error", tt.environ)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readEnv(%q): %v", tt.environ, err)
+			continue
+		}
+		want := DefaultSettings()
+		tt.want(want)
+		if !reflect.DeepEqual(s, want) {
+			t.Errorf("readEnv(%q) = %+v; want %+v", tt.environ, s, want)
+		}
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appenginetestinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	config := `{"app_id": "json-app", "version_id": "json", "environ": {"STAGE": "json", "REGION": "eu"}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := Setenv(map[string]string{
+		"APPENGINE_TEST_CONFIG":     path,
+		"APPENGINE_TEST_VERSION_ID": "env",
+		"APPENGINE_TEST_ENV_STAGE":  "env",
+	})
+	if err != nil {
+		t.Fatalf("Setenv: %v", err)
+	}
+	defer restore()
+
+	s, err := LoadSettings()
+	if err != nil {
+		t.Fatalf("LoadSettings: %v", err)
+	}
+	want := DefaultSettings()
+	want.AppId = "json-app"
+	want.VersionId = "env"
+	want.Environ = map[string]string{"STAGE": "env", "REGION": "eu"}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("LoadSettings() = %+v; want %+v", s, want)
+	}
+
+	c := s.config()
+	if string(c.AppId) != "json-app" || string(c.VersionId) != "env" || c.GetDatacenter() != "/" {
+		t.Errorf("config() = %v; want the settings", c)
+	}
+	if len(c.Environ) != 2 || string(c.Environ[0].Key) != "REGION" || string(c.Environ[1].Value) != "env" {
+		t.Errorf("got Environ %v; want REGION=eu and STAGE=env, sorted", c.Environ)
+	}
+}